@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/jmyounker/jtools/internal/mustache"
+	"github.com/urfave/cli"
+)
+
+// Items are indented by this much within an emitted chunk.
+const ITEM_PREFIX = "    "
+
+// Chunker collects records into chunks which are bounded by a number of
+// records and by the size of the chunk's record as it is emitted.  A record
+// which is larger than the byte limit is put in a chunk of its own.
+type Chunker struct {
+	size     int // records per chunk, or 0 for no limit
+	bytes    int // emitted bytes per chunk, or 0 for no limit
+	Overhead int // bytes of the chunk's record other than its items
+	items    []interface{}
+	used     int
+}
+
+func NewChunker(size int, bytes int) *Chunker {
+	return &Chunker{size: size, bytes: bytes, items: []interface{}{}}
+}
+
+// Add adds a record.  It returns the previous chunk when the record does
+// not fit into it, and nil otherwise.
+func (ch *Chunker) Add(v interface{}) ([]interface{}, error) {
+	n := 0
+	if ch.bytes > 0 {
+		enc, err := json.MarshalIndent(v, ITEM_PREFIX, "  ")
+		if err != nil {
+			return nil, err
+		}
+		// Each item starts on a new line.
+		n = len(enc) + len("\n"+ITEM_PREFIX)
+	}
+	var full []interface{}
+	if len(ch.items) > 0 && ((ch.size > 0 && len(ch.items) >= ch.size) || (ch.bytes > 0 && ch.Bytes()+len(",")+n > ch.bytes)) {
+		full = ch.Flush()
+	}
+	ch.items = append(ch.items, v)
+	ch.used = ch.used + n
+	return full, nil
+}
+
+// Bytes returns the size of the current chunk's record, including the
+// commas between its items, when a byte limit is set.
+func (ch *Chunker) Bytes() int {
+	if len(ch.items) == 0 {
+		return ch.Overhead
+	}
+	return ch.Overhead + ch.used + len(ch.items) - 1
+}
+
+// Flush returns the current chunk, or nil if it is empty, and starts a new
+// one.
+func (ch *Chunker) Flush() []interface{} {
+	if len(ch.items) == 0 {
+		return nil
+	}
+	full := ch.items
+	ch.items = []interface{}{}
+	ch.used = 0
+	return full
+}
+
+func chunkRecord(chunkCounter string, itemsVar string, cc int, items []interface{}) map[string]interface{} {
+	b := map[string]interface{}{}
+	b[chunkCounter] = cc
+	b[itemsVar] = items
+	return b
+}
+
+// chunkOverhead returns the size of a chunk's record other than its items.
+// An empty array is emitted as [], and a full one as [, its items and a
+// closing bracket on its own line.
+func chunkOverhead(chunkCounter string, itemsVar string, cc int) (int, error) {
+	out, err := json.MarshalIndent(chunkRecord(chunkCounter, itemsVar, cc, []interface{}{}), "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	return len(out) - len("[]") + len("[") + len("\n  ]"), nil
+}
+
+// ActionEmitChunks emits each chunk as a single record holding its items.
+func ActionEmitChunks(c *cli.Context) error {
+	size := c.Int("chunk-size")
+	bytes := c.Int("chunk-bytes")
+	if size < 1 && c.IsSet("chunk-size") {
+		return errors.New("chunk size must be positive")
+	}
+	if bytes < 0 {
+		return errors.New("chunk bytes cannot be negative")
+	}
+	var chunkBy *mustache.Template
+	if c.String("chunk-by") != "" {
+		t, err := mustache.ParseString(c.String("chunk-by"))
+		if err != nil {
+			return fmt.Errorf("could not parse chunk template %q: %s", c.String("chunk-by"), err)
+		}
+		chunkBy = t
+	}
+	if (bytes > 0 || chunkBy != nil) && !c.IsSet("chunk-size") {
+		// Only the other limits apply unless a size is given.
+		size = 0
+	}
+	chunkCounter := c.String("chunk-counter-var")
+	itemsVar := c.String("items-var")
+	ch := NewChunker(size, bytes)
+	cc := 0
+	overhead, err := chunkOverhead(chunkCounter, itemsVar, cc)
+	if err != nil {
+		return err
+	}
+	ch.Overhead = overhead
+	emit := func(items []interface{}) error {
+		out, err := json.MarshalIndent(chunkRecord(chunkCounter, itemsVar, cc, items), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(out))
+		cc = cc + 1
+		// The chunk counter's width changes the size of the next chunk.
+		ch.Overhead, err = chunkOverhead(chunkCounter, itemsVar, cc)
+		return err
+	}
+	key := ""
+	for x := range ReadJsonStream(os.Stdin) {
+		if x.Err != nil {
+			return x.Err
+		}
+		if chunkBy != nil {
+			k := chunkBy.Render(false, x.Value)
+			if k != key {
+				if full := ch.Flush(); full != nil {
+					if err := emit(full); err != nil {
+						return err
+					}
+				}
+				key = k
+			}
+		}
+		full, err := ch.Add(x.Value)
+		if err != nil {
+			return err
+		}
+		if full != nil {
+			if err := emit(full); err != nil {
+				return err
+			}
+		}
+	}
+	if last := ch.Flush(); last != nil {
+		return emit(last)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/jmyounker/jtools/internal/mustache"
+	"github.com/urfave/cli"
+)
+
+// Orders in which groups are emitted.
+const SORT_COUNT = "count" // largest count first
+const SORT_KEY = "key"     // keys in ascending order
+
+// Which record is kept as a group's example.
+const EXAMPLE_FIRST = "first"
+const EXAMPLE_LAST = "last"
+
+// Grouper counts records by the key rendered from a list of templates.
+// With one template the key is a string, and with several it is an array
+// of strings.
+type Grouper struct {
+	keys    []*mustache.Template
+	example string
+	groups  map[string]*Group
+}
+
+type Group struct {
+	Key     interface{}
+	Count   int
+	Example interface{}
+	parts   []string // the rendered key templates
+}
+
+func NewGrouper(keys []string, example string) (*Grouper, error) {
+	if example != "" && example != EXAMPLE_FIRST && example != EXAMPLE_LAST {
+		return nil, fmt.Errorf("example must be first or last and not %q", example)
+	}
+	g := &Grouper{example: example, groups: map[string]*Group{}}
+	for _, k := range keys {
+		tmpl, err := mustache.ParseString(k)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse group key %q: %s", k, err)
+		}
+		g.keys = append(g.keys, tmpl)
+	}
+	return g, nil
+}
+
+// Add counts a record and returns its group.
+func (g *Grouper) Add(v interface{}) *Group {
+	rendered := []string{}
+	for _, tmpl := range g.keys {
+		rendered = append(rendered, tmpl.Render(false, v))
+	}
+	id, _ := json.Marshal(rendered)
+	grp, ok := g.groups[string(id)]
+	if !ok {
+		grp = &Group{Key: rendered, parts: rendered}
+		if len(rendered) == 1 {
+			grp.Key = rendered[0]
+		}
+		g.groups[string(id)] = grp
+		if g.example == EXAMPLE_FIRST {
+			grp.Example = v
+		}
+	}
+	grp.Count = grp.Count + 1
+	if g.example == EXAMPLE_LAST {
+		grp.Example = v
+	}
+	return grp
+}
+
+// Sorted returns the groups in the given order.  When top is positive only
+// the first top groups are returned.
+func (g *Grouper) Sorted(order string, top int) ([]*Group, error) {
+	groups := []*Group{}
+	for _, grp := range g.groups {
+		groups = append(groups, grp)
+	}
+	switch order {
+	case SORT_COUNT:
+		sort.Slice(groups, func(i, j int) bool {
+			if groups[i].Count != groups[j].Count {
+				return groups[i].Count > groups[j].Count
+			}
+			return groups[i].less(groups[j])
+		})
+	case SORT_KEY:
+		sort.Slice(groups, func(i, j int) bool {
+			return groups[i].less(groups[j])
+		})
+	default:
+		return nil, checkSort(order)
+	}
+	if top > 0 && len(groups) > top {
+		groups = groups[:top]
+	}
+	return groups, nil
+}
+
+// checkSort rejects unknown orders, so that a bad --sort is reported
+// before the whole stream has been read.
+func checkSort(order string) error {
+	if order != SORT_COUNT && order != SORT_KEY {
+		return fmt.Errorf("sort must be count or key and not %q", order)
+	}
+	return nil
+}
+
+// less orders groups by their keys.
+func (grp *Group) less(other *Group) bool {
+	for i, p := range grp.parts {
+		if p != other.parts[i] {
+			return p < other.parts[i]
+		}
+	}
+	return false
+}
+
+// ActionGroup emits one record for each distinct group key with the number
+// of records in the group.
+func ActionGroup(c *cli.Context) error {
+	g, err := NewGrouper(c.StringSlice("group-by"), c.String("example"))
+	if err != nil {
+		return err
+	}
+	if err := checkSort(c.String("sort")); err != nil {
+		return err
+	}
+	for x := range ReadJsonStream(os.Stdin) {
+		if x.Err != nil {
+			return x.Err
+		}
+		g.Add(x.Value)
+	}
+	groups, err := g.Sorted(c.String("sort"), c.Int("top"))
+	if err != nil {
+		return err
+	}
+	for _, grp := range groups {
+		b := map[string]interface{}{}
+		b[c.String("key-var")] = grp.Key
+		b[c.String("count-var")] = grp.Count
+		if c.String("example") != "" {
+			b[c.String("body-var")] = grp.Example
+		}
+		out, err := json.MarshalIndent(b, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(out))
+	}
+	return nil
+}
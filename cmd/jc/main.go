@@ -2,16 +2,27 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sort"
 
+	"github.com/jmyounker/jtools/internal/mustache"
 	"github.com/urfave/cli"
 )
 
 var version string
 
 func main() {
+	err := NewApp().Run(os.Args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func NewApp() *cli.App {
 	app := cli.NewApp()
 	app.Usage = "Count JSON data."
 	app.Action = ActionCount
@@ -20,11 +31,174 @@ func main() {
 			Name:  "statistics, s",
 			Usage: "Emit statistics insead of records.",
 		},
+		cli.BoolFlag{
+			Name:  "profile, p",
+			Usage: "Emit statistics for every JSON path. Implies --statistics.",
+		},
+		cli.IntFlag{
+			Name:  "samples",
+			Usage: "Sample values kept for each path when profiling.",
+			Value: DEFAULT_SAMPLES,
+		},
+		cli.StringSliceFlag{
+			Name:  "group-by, g",
+			Usage: "Count records by a key template. Repeat for compound keys.",
+		},
+		cli.StringFlag{
+			Name:  "sort",
+			Usage: "Order groups by count or key.",
+			Value: SORT_COUNT,
+		},
+		cli.IntFlag{
+			Name:  "top",
+			Usage: "Emit only the first N groups.",
+		},
+		cli.StringFlag{
+			Name:  "example",
+			Usage: "Keep the first or last record of each group.",
+		},
+		cli.StringFlag{
+			Name:  "key-var",
+			Usage: "Group key attribute.",
+			Value: "key",
+		},
+		cli.StringFlag{
+			Name:  "count-var",
+			Usage: "Group count attribute.",
+			Value: "count",
+		},
 		cli.IntFlag{
 			Name:  "chunk-size, stride, c",
 			Usage: "Chunk size.",
 			Value: 1,
 		},
+		cli.StringFlag{
+			Name:  "chunk-by",
+			Usage: "Start a new chunk whenever this template's value changes.",
+		},
+		cli.BoolFlag{
+			Name:  "emit-chunks",
+			Usage: "Emit each chunk as a single record.",
+		},
+		cli.IntFlag{
+			Name:  "chunk-bytes",
+			Usage: "Limit emitted chunks to this many bytes of JSON.",
+		},
+		cli.StringFlag{
+			Name:  "items-var",
+			Usage: "Chunk items attribute.",
+			Value: "items",
+		},
+		cli.StringFlag{
+			Name:  "sample",
+			Usage: "Emit a sample of the records: every=N, fraction=F or reservoir=K.",
+		},
+		cli.Int64Flag{
+			Name:  "seed",
+			Usage: "Random seed for reproducible samples.",
+		},
+		cli.StringFlag{
+			Name:  "distinct",
+			Usage: "Estimate the number of distinct values of a template.",
+		},
+		cli.IntFlag{
+			Name:  "hll-precision",
+			Usage: "HyperLogLog precision for --distinct, from 4 to 18.",
+			Value: DEFAULT_HLL_PRECISION,
+		},
+		cli.IntFlag{
+			Name:  "top-k",
+			Usage: "Find the N most frequent values of the template argument.",
+		},
+		cli.IntFlag{
+			Name:  "top-k-capacity",
+			Usage: "Counters kept for --top-k. Defaults to ten per value.",
+		},
+		cli.StringFlag{
+			Name:  "quantiles",
+			Usage: "Estimate quantiles of a numeric template.",
+		},
+		cli.StringFlag{
+			Name:  "q",
+			Usage: "Comma separated quantiles for --quantiles.",
+			Value: DEFAULT_QUANTILES,
+		},
+		cli.Float64Flag{
+			Name:  "compression",
+			Usage: "T-digest compression for --quantiles. Larger is more accurate.",
+			Value: DEFAULT_COMPRESSION,
+		},
+		cli.StringFlag{
+			Name:  "histogram",
+			Usage: "Count the values of a numeric template in buckets.",
+		},
+		cli.StringFlag{
+			Name:  "buckets",
+			Usage: "Histogram buckets: linear=WIDTH or log=BASE.",
+		},
+		cli.StringFlag{
+			Name:  "time",
+			Usage: "Count records in time windows by a timestamp template.",
+		},
+		cli.DurationFlag{
+			Name:  "window",
+			Usage: "Length of each time window.",
+		},
+		cli.DurationFlag{
+			Name:  "slide",
+			Usage: "Time between the starts of windows. Defaults to the window length.",
+		},
+		cli.DurationFlag{
+			Name:  "lateness",
+			Usage: "How far out of order records may arrive.",
+		},
+		cli.StringFlag{
+			Name:  "epoch-unit",
+			Usage: "Unit of numeric timestamps: s, ms, us or ns.",
+			Value: "s",
+		},
+		cli.StringFlag{
+			Name:  "partition-by",
+			Usage: "Number the records of each partition key separately.",
+		},
+		cli.IntFlag{
+			Name:  "start",
+			Usage: "Index of the first record.",
+		},
+		cli.StringFlag{
+			Name:  "partition-var",
+			Usage: "Partition key attribute.",
+			Value: "p",
+		},
+		cli.BoolFlag{
+			Name:  "with-total",
+			Usage: "Read the whole stream first and number records against the total.",
+		},
+		cli.StringFlag{
+			Name:  "total-var",
+			Usage: "Total records attribute.",
+			Value: "n",
+		},
+		cli.StringFlag{
+			Name:  "reverse-counter-var",
+			Usage: "Reverse counter attribute.",
+			Value: "ri",
+		},
+		cli.StringFlag{
+			Name:  "first-var",
+			Usage: "First record attribute.",
+			Value: "first",
+		},
+		cli.StringFlag{
+			Name:  "last-var",
+			Usage: "Last record attribute.",
+			Value: "last",
+		},
+		cli.StringFlag{
+			Name:  "pct-var",
+			Usage: "Percentage attribute.",
+			Value: "pct",
+		},
 		cli.StringFlag{
 			Name:  "chunk-counter-var",
 			Usage: "Chunk counter attribute.",
@@ -47,34 +221,230 @@ func main() {
 		},
 	}
 	app.Version = version
+	return app
+}
 
-	err := app.Run(os.Args)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// Modes of operation.  Numbering records is the default.
+const MODE_NUMBER = "number"
+const MODE_GROUP = "group"
+const MODE_WINDOW = "window"
+const MODE_DISTRIBUTION = "distribution"
+const MODE_CHUNKS = "chunks"
+const MODE_SAMPLE = "sample"
+const MODE_SKETCH = "sketch"
+
+// The flags which choose a mode.  Earlier flags take precedence, so
+// --group-by only chooses grouping when no other mode is chosen.
+var MODE_FLAGS = []struct {
+	Flag string
+	Mode string
+}{
+	{"time", MODE_WINDOW},
+	{"quantiles", MODE_DISTRIBUTION},
+	{"histogram", MODE_DISTRIBUTION},
+	{"emit-chunks", MODE_CHUNKS},
+	{"sample", MODE_SAMPLE},
+	{"distinct", MODE_SKETCH},
+	{"top-k", MODE_SKETCH},
+	{"group-by", MODE_GROUP},
+}
+
+// The modes in which each flag applies.
+var FLAG_MODES = map[string][]string{
+	"statistics":          {MODE_NUMBER},
+	"profile":             {MODE_NUMBER},
+	"samples":             {MODE_NUMBER},
+	"group-by":            {MODE_GROUP, MODE_WINDOW, MODE_DISTRIBUTION},
+	"sort":                {MODE_GROUP, MODE_WINDOW, MODE_DISTRIBUTION},
+	"top":                 {MODE_GROUP, MODE_WINDOW, MODE_DISTRIBUTION},
+	"example":             {MODE_GROUP},
+	"key-var":             {MODE_GROUP, MODE_WINDOW, MODE_DISTRIBUTION},
+	"count-var":           {MODE_GROUP, MODE_WINDOW, MODE_DISTRIBUTION},
+	"chunk-size":          {MODE_NUMBER, MODE_CHUNKS, MODE_SAMPLE},
+	"chunk-by":            {MODE_NUMBER, MODE_CHUNKS},
+	"emit-chunks":         {MODE_CHUNKS},
+	"chunk-bytes":         {MODE_CHUNKS},
+	"items-var":           {MODE_CHUNKS},
+	"chunk-counter-var":   {MODE_NUMBER, MODE_CHUNKS, MODE_SAMPLE},
+	"sample":              {MODE_SAMPLE},
+	"seed":                {MODE_SAMPLE},
+	"distinct":            {MODE_SKETCH},
+	"hll-precision":       {MODE_SKETCH},
+	"top-k":               {MODE_SKETCH},
+	"top-k-capacity":      {MODE_SKETCH},
+	"quantiles":           {MODE_DISTRIBUTION},
+	"q":                   {MODE_DISTRIBUTION},
+	"compression":         {MODE_DISTRIBUTION},
+	"histogram":           {MODE_DISTRIBUTION},
+	"buckets":             {MODE_DISTRIBUTION},
+	"time":                {MODE_WINDOW},
+	"window":              {MODE_WINDOW},
+	"slide":               {MODE_WINDOW},
+	"lateness":            {MODE_WINDOW},
+	"epoch-unit":          {MODE_WINDOW},
+	"partition-by":        {MODE_NUMBER},
+	"start":               {MODE_NUMBER},
+	"partition-var":       {MODE_NUMBER},
+	"with-total":          {MODE_NUMBER},
+	"total-var":           {MODE_NUMBER},
+	"reverse-counter-var": {MODE_NUMBER},
+	"first-var":           {MODE_NUMBER},
+	"last-var":            {MODE_NUMBER},
+	"pct-var":             {MODE_NUMBER},
+	"counter-var":         {MODE_NUMBER, MODE_SAMPLE},
+	"stride-var":          {MODE_NUMBER, MODE_SAMPLE},
+	"body-var":            {MODE_NUMBER, MODE_SAMPLE, MODE_GROUP},
+}
+
+// chooseMode returns the mode selected by the flags, and rejects flags
+// which do not apply in that mode rather than silently ignoring them.
+func chooseMode(c *cli.Context) (string, error) {
+	mode := MODE_NUMBER
+	chosenBy := ""
+	for _, m := range MODE_FLAGS {
+		if !c.IsSet(m.Flag) {
+			continue
+		}
+		if chosenBy == "" {
+			mode = m.Mode
+			chosenBy = m.Flag
+		}
+	}
+	flags := []string{}
+	for f := range FLAG_MODES {
+		flags = append(flags, f)
+	}
+	sort.Strings(flags)
+	for _, f := range flags {
+		modes := FLAG_MODES[f]
+		if !c.IsSet(f) {
+			continue
+		}
+		applies := false
+		for _, m := range modes {
+			applies = applies || m == mode
+		}
+		if !applies {
+			if chosenBy == "" {
+				return "", fmt.Errorf("--%s cannot be used on its own", f)
+			}
+			return "", fmt.Errorf("--%s cannot be used with --%s", f, chosenBy)
+		}
 	}
+	return mode, nil
 }
 
 func ActionCount(c *cli.Context) error {
-	j := ReadJsonStream(os.Stdin)
-	reportStatistics := c.Bool("statistics")
+	mode, err := chooseMode(c)
+	if err != nil {
+		return err
+	}
+	switch mode {
+	case MODE_WINDOW:
+		return ActionWindow(c)
+	case MODE_DISTRIBUTION:
+		return ActionDistribution(c)
+	case MODE_GROUP:
+		return ActionGroup(c)
+	case MODE_CHUNKS:
+		return ActionEmitChunks(c)
+	case MODE_SAMPLE:
+		return ActionSample(c)
+	case MODE_SKETCH:
+		return ActionSketch(c)
+	}
+	reportStatistics := c.Bool("statistics") || c.Bool("profile")
+	var profile *Profile
+	if c.Bool("profile") {
+		profile = NewProfile(c.Int("samples"))
+	}
 	chunkSize := c.Int("chunk-size")
+	start := c.Int("start")
+	if start < 0 {
+		return errors.New("start cannot be negative")
+	}
+	if chunkSize < 1 {
+		return errors.New("chunk size must be positive")
+	}
+	var chunkBy *mustache.Template
+	if c.String("chunk-by") != "" {
+		t, err := mustache.ParseString(c.String("chunk-by"))
+		if err != nil {
+			return fmt.Errorf("could not parse chunk template %q: %s", c.String("chunk-by"), err)
+		}
+		chunkBy = t
+		if !c.IsSet("chunk-size") {
+			// Only key changes end chunks unless a size is given.
+			chunkSize = 0
+		}
+	}
+	var partition *mustache.Template
+	if c.String("partition-by") != "" {
+		t, err := mustache.ParseString(c.String("partition-by"))
+		if err != nil {
+			return fmt.Errorf("could not parse partition template %q: %s", c.String("partition-by"), err)
+		}
+		partition = t
+	}
+	var totals map[string]int
+	var j chan JsonRead
+	if c.Bool("with-total") && !reportStatistics {
+		spool, t, err := spoolStream(os.Stdin, partition)
+		if err != nil {
+			return fmt.Errorf("could not spool input: %s", err)
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		totals = t
+		j = ReadJsonStream(spool)
+	} else {
+		j = ReadJsonStream(os.Stdin)
+	}
 	counter := c.String("counter-var")
 	strideCounter := c.String("stride-var")
 	chunkCounter := c.String("chunk-counter-var")
+	partitionVar := c.String("partition-var")
 	body := c.String("body-var")
-	i := 0
-	s := 0
-	cc := 0
+	partitions := map[string]*Counters{}
+	records := 0
+	chunks := 0
 	b := map[string]interface{}{}
 	for x := range j {
 		if x.Err != nil {
 			return x.Err
 		}
+		if profile != nil {
+			profile.Add(x.Value)
+		}
+		key := ""
+		if partition != nil {
+			key = partition.Render(false, x.Value)
+		}
+		n, ok := partitions[key]
+		if !ok {
+			n = NewCounters(start, chunkSize)
+			partitions[key] = n
+		}
+		if chunkBy != nil && n.Rechunk(chunkBy.Render(false, x.Value)) {
+			chunks = chunks + 1
+		}
 		if !reportStatistics {
-			b[counter] = i
-			b[strideCounter] = s
-			b[chunkCounter] = cc
+			b[counter] = n.I
+			b[strideCounter] = n.S
+			b[chunkCounter] = n.C
+			if partition != nil {
+				b[partitionVar] = key
+			}
+			if totals != nil {
+				// The record's position within its partition.
+				k := n.I - start
+				total := totals[key]
+				b[c.String("total-var")] = total
+				b[c.String("reverse-counter-var")] = total - 1 - k
+				b[c.String("first-var")] = k == 0
+				b[c.String("last-var")] = k == total-1
+				b[c.String("pct-var")] = 100 * float64(k+1) / float64(total)
+			}
 			b[body] = x.Value
 			out, err := json.MarshalIndent(b, "", "  ")
 			if err != nil {
@@ -82,17 +452,31 @@ func ActionCount(c *cli.Context) error {
 			}
 			fmt.Print(string(out))
 		}
-		i = i + 1
-		s = s + 1
-		if s >= chunkSize {
-			s = 0
-			cc = cc + 1
+		records = records + 1
+		if n.Next(chunkSize) {
+			chunks = chunks + 1
 		}
 	}
 	if reportStatistics {
-		b["records"] = i
-		b["chunks"] = cc
-		b["chunk-size"] = chunkSize
+		if chunkBy != nil {
+			// The last chunk of each partition ends with the stream.
+			for _, n := range partitions {
+				if n.S > 0 {
+					chunks = chunks + 1
+				}
+			}
+		}
+		b["records"] = records
+		b["chunks"] = chunks
+		if chunkSize > 0 {
+			b["chunk-size"] = chunkSize
+		}
+		if partition != nil {
+			b["partitions"] = len(partitions)
+		}
+		if profile != nil {
+			b["paths"] = profile.Report()
+		}
 		out, err := json.MarshalIndent(b, "", "  ")
 		if err != nil {
 			return err
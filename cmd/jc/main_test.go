@@ -1 +1,332 @@
 package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmyounker/jtools/internal/mustache"
+	"github.com/urfave/cli"
+)
+
+func TestProfileSummarizesPaths(t *testing.T) {
+	p := NewProfile(2)
+	p.Add(map[string]interface{}{"a": 1.0, "b": []interface{}{"x", "yyy"}})
+	p.Add(map[string]interface{}{"a": 3.0, "c": nil})
+	r := p.Report()
+	a := r[".a"].(map[string]interface{})
+	n := a["number"].(*NumberStats)
+	if n.Min != 1 || n.Max != 3 || n.Mean != 2 || n.Stddev != 1 {
+		t.Fatalf("unexpected number stats %+v", n)
+	}
+	b := r[".b[]"].(map[string]interface{})
+	s := b["string"].(*StringStats)
+	if s.MinLength != 1 || s.MaxLength != 3 || b["missing-rate"].(float64) != 0.5 {
+		t.Fatalf("unexpected string stats %+v %v", s, b)
+	}
+	c := r[".c"].(map[string]interface{})
+	if c["null-rate"].(float64) != 1 || len(c["samples"].([]interface{})) != 1 {
+		t.Fatalf("unexpected null stats %v", c)
+	}
+}
+
+func TestGrouperCountsAndSorts(t *testing.T) {
+	g, err := NewGrouper([]string{"{{s}}"}, EXAMPLE_LAST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range []string{"b", "a", "b", "c", "b", "a"} {
+		g.Add(map[string]interface{}{"s": s, "n": float64(i)})
+	}
+	byCount, err := g.Sorted(SORT_COUNT, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byCount) != 2 || byCount[0].Key != "b" || byCount[0].Count != 3 || byCount[1].Key != "a" {
+		t.Fatalf("unexpected groups %+v", byCount)
+	}
+	if byCount[1].Example.(map[string]interface{})["n"] != 5.0 {
+		t.Fatalf("expected the last example but got %v", byCount[1].Example)
+	}
+	byKey, err := g.Sorted(SORT_KEY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byKey) != 3 || byKey[0].Key != "a" || byKey[2].Key != "c" {
+		t.Fatalf("unexpected groups %+v", byKey)
+	}
+}
+
+func TestChunkerBoundsCountAndBytes(t *testing.T) {
+	ch := NewChunker(3, 30)
+	sizes := []int{}
+	for _, v := range []interface{}{"a", "b", "c", "d", "a much longer string", "e"} {
+		full, err := ch.Add(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if full != nil {
+			sizes = append(sizes, len(full))
+		}
+	}
+	sizes = append(sizes, len(ch.Flush()))
+	if len(sizes) != 4 || sizes[0] != 3 || sizes[1] != 1 || sizes[2] != 1 || sizes[3] != 1 {
+		t.Fatalf("unexpected chunk sizes %v", sizes)
+	}
+}
+
+func TestChunkerMeasuresEmittedChunks(t *testing.T) {
+	ch := NewChunker(0, 200)
+	for cc := 9; cc < 11; cc++ {
+		overhead, err := chunkOverhead("c", "items", cc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch.Overhead = overhead
+		for _, v := range []interface{}{map[string]interface{}{"a": []interface{}{1, "x"}}, "b", 3.5} {
+			if _, err := ch.Add(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := ch.Bytes()
+		out, err := json.MarshalIndent(chunkRecord("c", "items", cc, ch.Flush()), "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != want || len(out) > 200 {
+			t.Fatalf("chunk %d measured %d bytes but emitted %d", cc, want, len(out))
+		}
+	}
+}
+
+func TestSamplerModes(t *testing.T) {
+	every, err := NewSampler("every=3", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := []int{}
+	for i := 0; i < 10; i++ {
+		if every.Offer(i, i) {
+			kept = append(kept, i)
+		}
+	}
+	if len(kept) != 4 || kept[3] != 9 {
+		t.Fatalf("unexpected every sample %v", kept)
+	}
+	res, err := NewSampler("reservoir=5", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if res.Offer(i, i) {
+			t.Fatal("reservoir records must not be kept immediately")
+		}
+	}
+	r := res.Reservoir()
+	if len(r) != 5 {
+		t.Fatalf("expected 5 records but got %d", len(r))
+	}
+	for j := 1; j < len(r); j++ {
+		if r[j].i <= r[j-1].i {
+			t.Fatalf("reservoir is not in stream order: %v", r)
+		}
+	}
+	if _, err := NewSampler("fraction=2", 1); err == nil {
+		t.Fatal("expected a fraction above one to fail")
+	}
+}
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	h, err := NewHyperLogLog(12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50000; i++ {
+		h.Add(fmt.Sprintf("user-%d", i%20000))
+	}
+	e := h.Estimate()
+	if math.Abs(e-20000)/20000 > 4*h.StandardError() {
+		t.Fatalf("estimate %f is too far from 20000", e)
+	}
+}
+
+func TestSpaceSavingFindsHeavyHitters(t *testing.T) {
+	ss, err := NewSpaceSaving(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		ss.Add(fmt.Sprintf("rare-%d", i))
+		if i%2 == 0 {
+			ss.Add("hot")
+		}
+	}
+	top := ss.Top(1)
+	if top[0].Key != "hot" || top[0].Count-top[0].Error > 500 || top[0].Count < 500 {
+		t.Fatalf("unexpected heavy hitter %+v", top[0])
+	}
+	if ss.ErrorBound() > ss.records/ss.capacity {
+		t.Fatalf("error bound %d exceeds %d", ss.ErrorBound(), ss.records/ss.capacity)
+	}
+}
+
+func TestWindowsHandleLateRecords(t *testing.T) {
+	w, err := NewWindows(time.Minute, time.Minute, 10*time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := []*Window{}
+	for _, s := range []string{"2024-01-01T00:00:50Z", "2024-01-01T00:01:05Z", "2024-01-01T00:00:58Z", "2024-01-01T00:01:20Z", "2024-01-01T00:00:59Z", "1704067290"} {
+		ts, err := parseTime(s, EPOCH_UNITS["s"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed = append(closed, w.Add(ts, s)...)
+	}
+	closed = append(closed, w.Flush()...)
+	if len(closed) != 2 || w.late != 1 {
+		t.Fatalf("expected two windows and one late record but got %d and %d", len(closed), w.late)
+	}
+	first, _ := closed[0].Groups.Sorted(SORT_COUNT, 0)
+	second, _ := closed[1].Groups.Sorted(SORT_COUNT, 0)
+	if first[0].Count != 2 || second[0].Count != 3 {
+		t.Fatalf("unexpected counts %d and %d", first[0].Count, second[0].Count)
+	}
+}
+
+func TestCountersStartMidChunk(t *testing.T) {
+	n := NewCounters(5, 4)
+	if n.I != 5 || n.S != 1 || n.C != 1 {
+		t.Fatalf("unexpected counters %+v", n)
+	}
+	completed := 0
+	for k := 0; k < 3; k++ {
+		if n.Next(4) {
+			completed = completed + 1
+		}
+	}
+	if n.I != 8 || n.S != 0 || n.C != 2 || completed != 1 {
+		t.Fatalf("unexpected counters %+v after %d chunks", n, completed)
+	}
+}
+
+func TestCountersRechunkOnKeyChange(t *testing.T) {
+	n := NewCounters(0, 0)
+	got := ""
+	for _, k := range []string{"a", "a", "b", "a", "a"} {
+		n.Rechunk(k)
+		got = got + fmt.Sprintf("%d%d ", n.C, n.S)
+		n.Next(0)
+	}
+	if got != "00 01 10 20 21 " {
+		t.Fatalf("unexpected chunks and strides %q", got)
+	}
+	n = NewCounters(5, 4)
+	if n.Rechunk("a") || n.C != 1 || n.S != 1 {
+		t.Fatalf("first record started a new chunk %+v", n)
+	}
+}
+
+func TestSpoolStreamCountsPartitions(t *testing.T) {
+	in, err := ioutil.TempFile("", "jc-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(in.Name())
+	defer in.Close()
+	in.WriteString(`{"g":"a"}{"g":"b"} {"g":"a"}`)
+	in.Seek(0, 0)
+	g, err := mustache.ParseString("{{g}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool, totals, err := spoolStream(in, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	if totals["a"] != 2 || totals["b"] != 1 {
+		t.Fatalf("unexpected totals %v", totals)
+	}
+	n := 0
+	for x := range ReadJsonStream(spool) {
+		if x.Err != nil {
+			t.Fatal(x.Err)
+		}
+		n = n + 1
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 spooled records but got %d", n)
+	}
+}
+
+func TestTDigestQuantiles(t *testing.T) {
+	td, err := NewTDigest(DEFAULT_COMPRESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100000; i++ {
+		// A permutation of 0..99999, so values do not arrive in order.
+		td.Add(float64(i * 7919 % 100000))
+	}
+	for _, q := range []float64{0.01, 0.5, 0.9, 0.99} {
+		if got := td.Quantile(q); math.Abs(got-q*100000) > 500 {
+			t.Errorf("quantile %g estimated as %g", q, got)
+		}
+	}
+	if len(td.centroids) > DEFAULT_COMPRESSION {
+		t.Errorf("kept %d centroids", len(td.centroids))
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h, err := NewHistogram("log=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []float64{0, 1, 5, 10, 99, 1000} {
+		h.Add(x)
+	}
+	got := ""
+	for _, b := range h.Buckets() {
+		got = got + fmt.Sprintf("%v-%v:%v ", b["lo"], b["hi"], b["count"])
+	}
+	if got != "1-10:2 10-100:2 1000-10000:1 " || h.nonpositive != 1 {
+		t.Fatalf("unexpected buckets %q with %d non-positive", got, h.nonpositive)
+	}
+}
+
+func TestChooseModeRejectsFlagsFromOtherModes(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		mode string
+	}{
+		{[]string{"-c", "2", "--profile"}, MODE_NUMBER},
+		{[]string{"-g", "{{x}}", "--top", "3"}, MODE_GROUP},
+		{[]string{"-g", "{{x}}", "--example", "first", "--body-var", "rec"}, MODE_GROUP},
+		{[]string{"--quantiles", "{{x}}", "-g", "{{y}}"}, MODE_DISTRIBUTION},
+		{[]string{"--emit-chunks", "--stride", "2"}, MODE_CHUNKS},
+		{[]string{"--sample", "every=2", "--counter-var", "n", "--body-var", "rec"}, MODE_SAMPLE},
+		{[]string{"--sample", "every=2", "--emit-chunks"}, ""},
+		{[]string{"-g", "{{x}}", "--profile"}, ""},
+		{[]string{"--with-total", "--sample", "every=2"}, ""},
+		{[]string{"--seed", "1"}, ""},
+	} {
+		app := NewApp()
+		mode := ""
+		var err error
+		app.Action = func(c *cli.Context) error {
+			mode, err = chooseMode(c)
+			return nil
+		}
+		app.Run(append([]string{"jc"}, tc.args...))
+		if mode != tc.mode || (tc.mode == "") != (err != nil) {
+			t.Errorf("%v chose %q with error %v", tc.args, mode, err)
+		}
+	}
+}
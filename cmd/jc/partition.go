@@ -0,0 +1,48 @@
+package main
+
+// Counters number the records of one partition of the stream.  A chunk
+// size of zero means that chunks are not limited in size.
+type Counters struct {
+	I   int    // the record's index
+	S   int    // the record's stride within its chunk
+	C   int    // the record's chunk
+	Key string // the chunk key of the previous record
+
+	started bool // whether a record has been seen
+}
+
+// NewCounters starts numbering at record start.
+func NewCounters(start int, chunkSize int) *Counters {
+	if chunkSize == 0 {
+		return &Counters{I: start}
+	}
+	return &Counters{I: start, S: start % chunkSize, C: start / chunkSize}
+}
+
+// Rechunk starts a new chunk if key differs from the previous record's
+// key.  The first record never starts a new chunk, even when the start
+// index puts it part way through one.  It reports whether a chunk was
+// completed.
+func (n *Counters) Rechunk(key string) bool {
+	changed := n.started && n.Key != key && n.S > 0
+	n.Key = key
+	n.started = true
+	if changed {
+		n.S = 0
+		n.C = n.C + 1
+	}
+	return changed
+}
+
+// Next advances to the next record.  It reports whether a chunk was
+// completed.
+func (n *Counters) Next(chunkSize int) bool {
+	n.I = n.I + 1
+	n.S = n.S + 1
+	if chunkSize > 0 && n.S >= chunkSize {
+		n.S = 0
+		n.C = n.C + 1
+		return true
+	}
+	return false
+}
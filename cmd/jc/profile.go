@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"unicode/utf8"
+)
+
+// Number of sample values kept for each path.
+const DEFAULT_SAMPLES = 3
+
+// Profile summarizes every JSON path which occurs in a stream of records.
+// Paths are written like jq paths: `.a.b` for a field and `.a[]` for the
+// elements of an array.  The root is `.`.
+type Profile struct {
+	records int
+	samples int
+	paths   map[string]*PathStats
+}
+
+// PathStats summarizes the values found at one path.
+type PathStats struct {
+	count   int            // values seen
+	records int            // records containing the path
+	last    int            // last record counted in records
+	types   map[string]int // values seen by JSON type
+	nulls   int
+	num     *NumberStats
+	str     *StringStats
+	samples []interface{}
+	seen    map[string]bool // encoded samples
+}
+
+// NumberStats uses Welford's algorithm so that the mean and standard
+// deviation can be computed in a single pass.
+type NumberStats struct {
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	Stddev float64 `json:"stddev"`
+	n      int
+	m2     float64
+}
+
+type StringStats struct {
+	MinLength int `json:"min-length"`
+	MaxLength int `json:"max-length"`
+}
+
+func NewProfile(samples int) *Profile {
+	return &Profile{samples: samples, paths: map[string]*PathStats{}}
+}
+
+// Add profiles one record.
+func (p *Profile) Add(v interface{}) {
+	p.records = p.records + 1
+	p.walk(".", v)
+}
+
+func (p *Profile) walk(path string, v interface{}) {
+	p.stats(path).add(v, p.records, p.samples)
+	prefix := path
+	if path == "." {
+		prefix = ""
+	}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, e := range x {
+			p.walk(prefix+"."+k, e)
+		}
+	case []interface{}:
+		for _, e := range x {
+			p.walk(prefix+"[]", e)
+		}
+	}
+}
+
+func (p *Profile) stats(path string) *PathStats {
+	s, ok := p.paths[path]
+	if !ok {
+		s = &PathStats{types: map[string]int{}, seen: map[string]bool{}}
+		p.paths[path] = s
+	}
+	return s
+}
+
+func (s *PathStats) add(v interface{}, record int, samples int) {
+	s.count = s.count + 1
+	if s.last != record {
+		s.records = s.records + 1
+		s.last = record
+	}
+	t := jsonType(v)
+	s.types[t] = s.types[t] + 1
+	switch x := v.(type) {
+	case nil:
+		s.nulls = s.nulls + 1
+	case float64:
+		if s.num == nil {
+			s.num = &NumberStats{Min: x, Max: x}
+		}
+		s.num.add(x)
+	case string:
+		n := utf8.RuneCountInString(x)
+		if s.str == nil {
+			s.str = &StringStats{MinLength: n, MaxLength: n}
+		}
+		if n < s.str.MinLength {
+			s.str.MinLength = n
+		}
+		if n > s.str.MaxLength {
+			s.str.MaxLength = n
+		}
+	}
+	if t == "object" || t == "array" || len(s.samples) >= samples {
+		return
+	}
+	k, err := json.Marshal(v)
+	if err != nil || s.seen[string(k)] {
+		return
+	}
+	s.seen[string(k)] = true
+	s.samples = append(s.samples, v)
+}
+
+func (n *NumberStats) add(x float64) {
+	n.n = n.n + 1
+	if x < n.Min {
+		n.Min = x
+	}
+	if x > n.Max {
+		n.Max = x
+	}
+	d := x - n.Mean
+	n.Mean = n.Mean + d/float64(n.n)
+	n.m2 = n.m2 + d*(x-n.Mean)
+	n.Stddev = math.Sqrt(n.m2 / float64(n.n))
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// Report returns the profile of each path, ready to be encoded as JSON.
+func (p *Profile) Report() map[string]interface{} {
+	r := map[string]interface{}{}
+	for path, s := range p.paths {
+		ps := map[string]interface{}{
+			"count":        s.count,
+			"types":        s.types,
+			"null-rate":    float64(s.nulls) / float64(s.count),
+			"missing-rate": float64(p.records-s.records) / float64(p.records),
+		}
+		if s.num != nil {
+			ps["number"] = s.num
+		}
+		if s.str != nil {
+			ps["string"] = s.str
+		}
+		if len(s.samples) > 0 {
+			ps["samples"] = s.samples
+		}
+		r[path] = ps
+	}
+	return r
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmyounker/jtools/internal/mustache"
+	"github.com/urfave/cli"
+)
+
+// Default t-digest compression.  Larger values keep more centroids and give
+// more accurate quantiles.
+const DEFAULT_COMPRESSION = 100
+
+// Quantiles reported unless others are requested.
+const DEFAULT_QUANTILES = "0.5,0.9,0.99"
+
+// TDigest estimates quantiles of a stream of numbers in bounded memory.
+// Values are clustered into centroids which are small near the extremes,
+// so tail quantiles stay accurate.
+type TDigest struct {
+	compression float64
+	centroids   []centroid
+	buffer      []centroid
+	total       float64
+	min         float64
+	max         float64
+}
+
+type centroid struct {
+	mean  float64
+	count float64
+}
+
+func NewTDigest(compression float64) (*TDigest, error) {
+	if compression < 10 {
+		return nil, errors.New("compression must be at least 10")
+	}
+	return &TDigest{compression: compression, min: math.Inf(1), max: math.Inf(-1)}, nil
+}
+
+func (td *TDigest) Add(x float64) {
+	td.buffer = append(td.buffer, centroid{x, 1})
+	td.total = td.total + 1
+	td.min = math.Min(td.min, x)
+	td.max = math.Max(td.max, x)
+	if len(td.buffer) >= int(5*td.compression) {
+		td.merge()
+	}
+}
+
+// merge folds the buffered values into the centroids.  Neighbouring
+// centroids are combined while they span at most one unit of the scale
+// function, which allows large centroids near the median and small ones
+// toward the tails.
+func (td *TDigest) merge() {
+	if len(td.buffer) == 0 {
+		return
+	}
+	all := append(td.centroids, td.buffer...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+	merged := []centroid{}
+	cur := all[0]
+	seen := 0.0
+	limit := td.scale(0) + 1
+	for _, next := range all[1:] {
+		count := cur.count + next.count
+		if td.scale((seen+count)/td.total) <= limit {
+			cur.mean = cur.mean + (next.mean-cur.mean)*next.count/count
+			cur.count = count
+		} else {
+			seen = seen + cur.count
+			merged = append(merged, cur)
+			cur = next
+			limit = td.scale(seen/td.total) + 1
+		}
+	}
+	td.centroids = append(merged, cur)
+	td.buffer = nil
+}
+
+// scale maps a quantile onto the t-digest's k1 scale, which runs from
+// -compression/4 to compression/4.
+func (td *TDigest) scale(q float64) float64 {
+	return td.compression / (2 * math.Pi) * math.Asin(2*math.Min(q, 1)-1)
+}
+
+// Quantile returns the estimated value at quantile q, which is between 0
+// and 1.
+func (td *TDigest) Quantile(q float64) float64 {
+	td.merge()
+	if len(td.centroids) == 0 {
+		return math.NaN()
+	}
+	if len(td.centroids) == 1 {
+		return td.centroids[0].mean
+	}
+	// Each centroid's mean sits at the middle of its weight, and the
+	// extremes sit at the ends.  Interpolate between neighbours.
+	target := q * td.total
+	prevAt := 0.0
+	prevMean := td.min
+	seen := 0.0
+	for _, c := range td.centroids {
+		at := seen + c.count/2
+		if target < at {
+			return interpolate(target, prevAt, prevMean, at, c.mean)
+		}
+		prevAt = at
+		prevMean = c.mean
+		seen = seen + c.count
+	}
+	return interpolate(target, prevAt, prevMean, td.total, td.max)
+}
+
+func interpolate(x, x0, y0, x1, y1 float64) float64 {
+	if x1 <= x0 {
+		return y1
+	}
+	return y0 + (y1-y0)*(x-x0)/(x1-x0)
+}
+
+// Bucket schemes for histograms.
+const BUCKETS_LINEAR = "linear" // buckets of a fixed width
+const BUCKETS_LOG = "log"       // buckets growing by a fixed factor
+
+// Histogram counts values in buckets.  Only buckets with values are kept.
+// Logarithmic buckets cannot hold zero or negative values, so those are
+// counted separately.
+type Histogram struct {
+	scheme      string
+	param       float64
+	buckets     map[int]int
+	nonpositive int
+}
+
+// NewHistogram parses a bucket spec of the form linear=WIDTH or log=BASE.
+func NewHistogram(spec string) (*Histogram, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("buckets must be linear=WIDTH or log=BASE and not %q", spec)
+	}
+	p, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse bucket parameter %q", parts[1])
+	}
+	switch parts[0] {
+	case BUCKETS_LINEAR:
+		if p <= 0 {
+			return nil, errors.New("bucket width must be positive")
+		}
+	case BUCKETS_LOG:
+		if p <= 1 {
+			return nil, errors.New("bucket base must be greater than one")
+		}
+	default:
+		return nil, fmt.Errorf("unknown bucket scheme %q", parts[0])
+	}
+	return &Histogram{scheme: parts[0], param: p, buckets: map[int]int{}}, nil
+}
+
+func (h *Histogram) Add(x float64) {
+	if h.scheme == BUCKETS_LINEAR {
+		i := int(math.Floor(x / h.param))
+		h.buckets[i] = h.buckets[i] + 1
+		return
+	}
+	if x <= 0 {
+		h.nonpositive = h.nonpositive + 1
+		return
+	}
+	i := int(math.Floor(math.Log(x) / math.Log(h.param)))
+	// Correct for rounding at exact powers of the base.
+	if lo, hi := h.bounds(i); x >= hi {
+		i = i + 1
+	} else if x < lo {
+		i = i - 1
+	}
+	h.buckets[i] = h.buckets[i] + 1
+}
+
+// bounds returns the range of values in bucket i.
+func (h *Histogram) bounds(i int) (float64, float64) {
+	if h.scheme == BUCKETS_LINEAR {
+		return float64(i) * h.param, float64(i+1) * h.param
+	}
+	return math.Pow(h.param, float64(i)), math.Pow(h.param, float64(i+1))
+}
+
+// Buckets returns the non-empty buckets in ascending order.
+func (h *Histogram) Buckets() []map[string]interface{} {
+	idx := []int{}
+	for i := range h.buckets {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+	out := []map[string]interface{}{}
+	for _, i := range idx {
+		lo, hi := h.bounds(i)
+		out = append(out, map[string]interface{}{"lo": lo, "hi": hi, "count": h.buckets[i]})
+	}
+	return out
+}
+
+// parseQuantiles parses a comma separated list of quantiles.
+func parseQuantiles(s string) ([]float64, error) {
+	qs := []float64{}
+	for _, part := range strings.Split(s, ",") {
+		q, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || q < 0 || q > 1 {
+			return nil, fmt.Errorf("quantiles must be between 0 and 1 and not %q", part)
+		}
+		qs = append(qs, q)
+	}
+	return qs, nil
+}
+
+// distribution holds the numeric summaries of one group.
+type distribution struct {
+	digest  *TDigest
+	hist    *Histogram
+	invalid int // records with a value which is not a number
+}
+
+// ActionDistribution reports quantiles and histograms of numeric values,
+// optionally for each group.
+func ActionDistribution(c *cli.Context) error {
+	var quantileTmpl, histTmpl *mustache.Template
+	var qs []float64
+	if c.String("quantiles") != "" {
+		t, err := mustache.ParseString(c.String("quantiles"))
+		if err != nil {
+			return fmt.Errorf("could not parse quantiles template %q: %s", c.String("quantiles"), err)
+		}
+		quantileTmpl = t
+		qs, err = parseQuantiles(c.String("q"))
+		if err != nil {
+			return err
+		}
+		if _, err := NewTDigest(c.Float64("compression")); err != nil {
+			return err
+		}
+	}
+	if c.String("histogram") != "" {
+		t, err := mustache.ParseString(c.String("histogram"))
+		if err != nil {
+			return fmt.Errorf("could not parse histogram template %q: %s", c.String("histogram"), err)
+		}
+		histTmpl = t
+		if c.String("buckets") == "" {
+			return errors.New("--histogram requires --buckets")
+		}
+		if _, err := NewHistogram(c.String("buckets")); err != nil {
+			return err
+		}
+	}
+	keys := c.StringSlice("group-by")
+	g, err := NewGrouper(keys, "")
+	if err != nil {
+		return err
+	}
+	if err := checkSort(c.String("sort")); err != nil {
+		return err
+	}
+	dists := map[*Group]*distribution{}
+	value := func(tmpl *mustache.Template, v interface{}) (float64, bool) {
+		x, err := strconv.ParseFloat(strings.TrimSpace(tmpl.Render(false, v)), 64)
+		return x, err == nil && !math.IsNaN(x) && !math.IsInf(x, 0)
+	}
+	for x := range ReadJsonStream(os.Stdin) {
+		if x.Err != nil {
+			return x.Err
+		}
+		grp := g.Add(x.Value)
+		d, ok := dists[grp]
+		if !ok {
+			d = &distribution{}
+			if quantileTmpl != nil {
+				d.digest, _ = NewTDigest(c.Float64("compression"))
+			}
+			if histTmpl != nil {
+				d.hist, _ = NewHistogram(c.String("buckets"))
+			}
+			dists[grp] = d
+		}
+		// A record is counted as invalid once, even when neither value
+		// is a number.
+		valid := true
+		if quantileTmpl != nil {
+			if v, ok := value(quantileTmpl, x.Value); ok {
+				d.digest.Add(v)
+			} else {
+				valid = false
+			}
+		}
+		if histTmpl != nil {
+			if v, ok := value(histTmpl, x.Value); ok {
+				d.hist.Add(v)
+			} else {
+				valid = false
+			}
+		}
+		if !valid {
+			d.invalid = d.invalid + 1
+		}
+	}
+	groups, err := g.Sorted(c.String("sort"), c.Int("top"))
+	if err != nil {
+		return err
+	}
+	for _, grp := range groups {
+		d := dists[grp]
+		b := map[string]interface{}{}
+		if len(keys) > 0 {
+			b[c.String("key-var")] = grp.Key
+		}
+		b[c.String("count-var")] = grp.Count
+		if d.invalid > 0 {
+			b["invalid"] = d.invalid
+		}
+		if d.digest != nil && d.digest.total > 0 {
+			quantiles := map[string]float64{}
+			for _, q := range qs {
+				quantiles[strconv.FormatFloat(q, 'g', -1, 64)] = d.digest.Quantile(q)
+			}
+			b["quantiles"] = quantiles
+			b["min"] = d.digest.min
+			b["max"] = d.digest.max
+		}
+		if d.hist != nil {
+			b["histogram"] = d.hist.Buckets()
+			if d.hist.nonpositive > 0 {
+				b["nonpositive"] = d.hist.nonpositive
+			}
+		}
+		out, err := json.MarshalIndent(b, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(out))
+	}
+	return nil
+}
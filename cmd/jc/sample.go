@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Sampling modes.
+const SAMPLE_EVERY = "every"         // every Nth record
+const SAMPLE_FRACTION = "fraction"   // each record with a fixed probability
+const SAMPLE_RESERVOIR = "reservoir" // a uniform sample of exactly K records
+
+// Sampler chooses which records of a stream are kept.
+type Sampler struct {
+	mode     string
+	every    int
+	fraction float64
+	rnd      *rand.Rand
+	kept     []sampled // the reservoir
+	size     int       // the size of the reservoir
+}
+
+type sampled struct {
+	i int
+	v interface{}
+}
+
+// NewSampler parses a sampling spec of the form MODE=VALUE.
+func NewSampler(spec string, seed int64) (*Sampler, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("sample must be every=N, fraction=F or reservoir=K and not %q", spec)
+	}
+	s := &Sampler{mode: parts[0], rnd: rand.New(rand.NewSource(seed))}
+	switch s.mode {
+	case SAMPLE_EVERY, SAMPLE_RESERVOIR:
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%s must be a positive integer and not %q", s.mode, parts[1])
+		}
+		s.every = n
+		s.size = n
+	case SAMPLE_FRACTION:
+		f, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || f < 0 || f > 1 {
+			return nil, fmt.Errorf("fraction must be between 0 and 1 and not %q", parts[1])
+		}
+		s.fraction = f
+	default:
+		return nil, fmt.Errorf("unknown sampling mode %q", s.mode)
+	}
+	return s, nil
+}
+
+// Offer presents the record with index i.  It reports whether the record
+// is kept straight away.  Reservoir samples are only known once the stream
+// ends, so they are returned by Reservoir.
+func (s *Sampler) Offer(i int, v interface{}) bool {
+	switch s.mode {
+	case SAMPLE_EVERY:
+		return i%s.every == 0
+	case SAMPLE_FRACTION:
+		return s.rnd.Float64() < s.fraction
+	}
+	// Algorithm R: the record replaces a random member of the reservoir
+	// with probability size/(i+1).
+	if len(s.kept) < s.size {
+		s.kept = append(s.kept, sampled{i, v})
+	} else if j := s.rnd.Intn(i + 1); j < s.size {
+		s.kept[j] = sampled{i, v}
+	}
+	return false
+}
+
+// Reservoir returns the records in the reservoir in stream order.
+func (s *Sampler) Reservoir() []sampled {
+	sort.Slice(s.kept, func(a, b int) bool { return s.kept[a].i < s.kept[b].i })
+	return s.kept
+}
+
+// ActionSample emits a sample of the records.  Each is numbered by its
+// position in the original stream.
+func ActionSample(c *cli.Context) error {
+	seed := c.Int64("seed")
+	if !c.IsSet("seed") {
+		seed = time.Now().UnixNano()
+	}
+	s, err := NewSampler(c.String("sample"), seed)
+	if err != nil {
+		return err
+	}
+	chunkSize := c.Int("chunk-size")
+	if chunkSize < 1 {
+		return errors.New("chunk size must be positive")
+	}
+	emit := func(i int, v interface{}) error {
+		b := map[string]interface{}{}
+		b[c.String("counter-var")] = i
+		b[c.String("stride-var")] = i % chunkSize
+		b[c.String("chunk-counter-var")] = i / chunkSize
+		b[c.String("body-var")] = v
+		out, err := json.MarshalIndent(b, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(out))
+		return nil
+	}
+	i := 0
+	for x := range ReadJsonStream(os.Stdin) {
+		if x.Err != nil {
+			return x.Err
+		}
+		if s.Offer(i, x.Value) {
+			if err := emit(i, x.Value); err != nil {
+				return err
+			}
+		}
+		i = i + 1
+	}
+	for _, r := range s.Reservoir() {
+		if err := emit(r.i, r.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+
+	"github.com/jmyounker/jtools/internal/mustache"
+	"github.com/urfave/cli"
+)
+
+// HyperLogLog precision used unless another is given.  It uses 2^14 one
+// byte registers and has a standard error of about 0.8%.
+const DEFAULT_HLL_PRECISION = 14
+
+// Space-saving counters kept for each requested heavy hitter unless a
+// capacity is given.
+const TOP_K_CAPACITY_FACTOR = 10
+
+// HyperLogLog estimates the number of distinct values in a stream in a
+// fixed amount of memory.
+type HyperLogLog struct {
+	p         uint
+	registers []uint8
+}
+
+func NewHyperLogLog(p int) (*HyperLogLog, error) {
+	if p < 4 || p > 18 {
+		return nil, fmt.Errorf("hyperloglog precision must be between 4 and 18 and not %d", p)
+	}
+	return &HyperLogLog{p: uint(p), registers: make([]uint8, 1<<uint(p))}, nil
+}
+
+func (h *HyperLogLog) Add(s string) {
+	x := hash64(s)
+	i := x >> (64 - h.p)
+	// The sentinel bit bounds the run of zeros for the remaining bits.
+	w := x<<h.p | 1<<(h.p-1)
+	rho := uint8(bits.LeadingZeros64(w) + 1)
+	if rho > h.registers[i] {
+		h.registers[i] = rho
+	}
+}
+
+// Estimate returns the approximate number of distinct values added.
+func (h *HyperLogLog) Estimate() float64 {
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum = sum + math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros = zeros + 1
+		}
+	}
+	e := hllAlpha(len(h.registers)) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities.
+		e = m * math.Log(m/float64(zeros))
+	}
+	return e
+}
+
+// StandardError is the relative standard error of the estimate.
+func (h *HyperLogLog) StandardError() float64 {
+	return 1.04 / math.Sqrt(float64(len(h.registers)))
+}
+
+func hllAlpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+	return 0.7213 / (1 + 1.079/float64(m))
+}
+
+// hash64 is FNV-1a followed by the splitmix64 finalizer, which spreads
+// similar keys across all of the bits.
+func hash64(s string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	x := f.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// SpaceSaving finds the most frequent values in a stream using a fixed
+// number of counters.  When every counter is in use a new value takes over
+// the smallest counter, and that counter's count becomes the new value's
+// possible overestimate.  Any value which occurs more than records/capacity
+// times is guaranteed to be counted.
+type SpaceSaving struct {
+	capacity int
+	records  int
+	counters map[string]*ssCounter
+	heap     ssHeap
+}
+
+type ssCounter struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+	Error int    `json:"error"`
+	index int
+}
+
+func NewSpaceSaving(capacity int) (*SpaceSaving, error) {
+	if capacity < 1 {
+		return nil, errors.New("top-k capacity must be positive")
+	}
+	return &SpaceSaving{capacity: capacity, counters: map[string]*ssCounter{}}, nil
+}
+
+func (ss *SpaceSaving) Add(key string) {
+	ss.records = ss.records + 1
+	if c, ok := ss.counters[key]; ok {
+		c.Count = c.Count + 1
+		heap.Fix(&ss.heap, c.index)
+		return
+	}
+	if len(ss.counters) < ss.capacity {
+		c := &ssCounter{Key: key, Count: 1}
+		ss.counters[key] = c
+		heap.Push(&ss.heap, c)
+		return
+	}
+	c := ss.heap[0]
+	delete(ss.counters, c.Key)
+	c.Key = key
+	c.Error = c.Count
+	c.Count = c.Count + 1
+	ss.counters[key] = c
+	heap.Fix(&ss.heap, 0)
+}
+
+// Top returns the k values with the largest counts.
+func (ss *SpaceSaving) Top(k int) []*ssCounter {
+	top := append([]*ssCounter{}, ss.heap...)
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+	if len(top) > k {
+		top = top[:k]
+	}
+	return top
+}
+
+// ErrorBound is the largest amount by which any count can be overstated.
+func (ss *SpaceSaving) ErrorBound() int {
+	if len(ss.counters) < ss.capacity {
+		return 0
+	}
+	return ss.heap[0].Count
+}
+
+// ssHeap is a min-heap of counters.
+type ssHeap []*ssCounter
+
+func (h ssHeap) Len() int           { return len(h) }
+func (h ssHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h ssHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *ssHeap) Push(x interface{}) {
+	c := x.(*ssCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *ssHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// ActionSketch reports approximate distinct counts and heavy hitters in
+// bounded memory.
+func ActionSketch(c *cli.Context) error {
+	var distinct *mustache.Template
+	var hll *HyperLogLog
+	if c.String("distinct") != "" {
+		t, err := mustache.ParseString(c.String("distinct"))
+		if err != nil {
+			return fmt.Errorf("could not parse distinct template %q: %s", c.String("distinct"), err)
+		}
+		distinct = t
+		hll, err = NewHyperLogLog(c.Int("hll-precision"))
+		if err != nil {
+			return err
+		}
+	}
+	var topKey *mustache.Template
+	var ss *SpaceSaving
+	k := c.Int("top-k")
+	if k < 0 {
+		return errors.New("top-k must be positive")
+	}
+	if k > 0 {
+		if c.NArg() == 0 {
+			return errors.New("--top-k requires a key template")
+		}
+		t, err := mustache.ParseString(c.Args().Get(0))
+		if err != nil {
+			return fmt.Errorf("could not parse top-k template %q: %s", c.Args().Get(0), err)
+		}
+		topKey = t
+		capacity := c.Int("top-k-capacity")
+		if capacity == 0 {
+			capacity = TOP_K_CAPACITY_FACTOR * k
+		}
+		ss, err = NewSpaceSaving(capacity)
+		if err != nil {
+			return err
+		}
+	}
+	i := 0
+	for x := range ReadJsonStream(os.Stdin) {
+		if x.Err != nil {
+			return x.Err
+		}
+		if hll != nil {
+			hll.Add(distinct.Render(false, x.Value))
+		}
+		if ss != nil {
+			ss.Add(topKey.Render(false, x.Value))
+		}
+		i = i + 1
+	}
+	b := map[string]interface{}{}
+	b["records"] = i
+	if hll != nil {
+		b["distinct"] = map[string]interface{}{
+			"estimate":       math.Round(hll.Estimate()),
+			"precision":      hll.p,
+			"standard-error": hll.StandardError(),
+		}
+	}
+	if ss != nil {
+		b["top-k"] = map[string]interface{}{
+			"capacity":    ss.capacity,
+			"error-bound": ss.ErrorBound(),
+			"items":       ss.Top(k),
+		}
+	}
+	out, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(out))
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/jmyounker/jtools/internal/mustache"
+)
+
+// spoolStream copies every record of the stream into a temporary file so
+// that it can be read a second time, and counts the records in each
+// partition.  The file is positioned at its start, and the caller must
+// close and remove it.
+func spoolStream(stream *os.File, partition *mustache.Template) (*os.File, map[string]int, error) {
+	f, err := ioutil.TempFile("", "jc-")
+	if err != nil {
+		return nil, nil, err
+	}
+	totals := map[string]int{}
+	w := bufio.NewWriter(f)
+	fail := func(err error) (*os.File, map[string]int, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+	for x := range ReadJsonStream(stream) {
+		if x.Err != nil {
+			return fail(x.Err)
+		}
+		key := ""
+		if partition != nil {
+			key = partition.Render(false, x.Value)
+		}
+		totals[key] = totals[key] + 1
+		enc, err := json.Marshal(x.Value)
+		if err != nil {
+			return fail(err)
+		}
+		w.Write(enc)
+		if err := w.WriteByte('\n'); err != nil {
+			return fail(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return fail(err)
+	}
+	return f, totals, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmyounker/jtools/internal/mustache"
+	"github.com/urfave/cli"
+)
+
+// Nanoseconds in each unit of an epoch timestamp.
+var EPOCH_UNITS = map[string]float64{
+	"s":  1e9,
+	"ms": 1e6,
+	"us": 1e3,
+	"ns": 1,
+}
+
+// parseTime parses an RFC 3339 timestamp or a number of units since the
+// epoch, and returns nanoseconds since the epoch.
+func parseTime(s string, unit float64) (int64, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UnixNano(), nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		// Integers are exact where floats would lose nanoseconds.
+		return n * int64(unit), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse time %q", s)
+	}
+	return int64(f * unit), nil
+}
+
+// Windows counts records in time windows of a fixed length which start
+// every slide.  With a slide equal to the length the windows tumble, and
+// each record falls in exactly one.
+//
+// Records may arrive out of order.  The watermark trails the latest time
+// seen by the lateness, and a window is closed once the watermark reaches
+// its end.  Records which only belong to closed windows are dropped as late.
+type Windows struct {
+	length    int64
+	slide     int64
+	lateness  int64
+	keys      []string
+	open      map[int64]*Grouper
+	watermark int64
+	started   bool
+	late      int
+}
+
+// A closed window and its groups.
+type Window struct {
+	Start  int64
+	End    int64
+	Groups *Grouper
+}
+
+func NewWindows(length, slide, lateness time.Duration, keys []string) (*Windows, error) {
+	if length <= 0 || slide <= 0 {
+		return nil, errors.New("window and slide must be positive")
+	}
+	if slide > length {
+		return nil, errors.New("slide cannot be longer than the window")
+	}
+	if lateness < 0 {
+		return nil, errors.New("lateness cannot be negative")
+	}
+	w := &Windows{
+		length:   int64(length),
+		slide:    int64(slide),
+		lateness: int64(lateness),
+		keys:     keys,
+		open:     map[int64]*Grouper{},
+	}
+	// Check the key templates before any records are read.
+	if _, err := NewGrouper(keys, ""); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Add counts a record at time t, and returns the windows which can no
+// longer receive records.
+func (w *Windows) Add(t int64, v interface{}) []*Window {
+	if !w.started || t-w.lateness > w.watermark {
+		w.watermark = t - w.lateness
+		w.started = true
+	}
+	counted := false
+	for start := w.last(t); start > t-w.length; start = start - w.slide {
+		if start+w.length <= w.watermark {
+			// Earlier windows are closed too.
+			break
+		}
+		g, ok := w.open[start]
+		if !ok {
+			g, _ = NewGrouper(w.keys, "")
+			w.open[start] = g
+		}
+		g.Add(v)
+		counted = true
+	}
+	if !counted {
+		w.late = w.late + 1
+	}
+	return w.expire(w.watermark)
+}
+
+// Flush returns every open window.
+func (w *Windows) Flush() []*Window {
+	return w.expire(1<<63 - 1)
+}
+
+// expire closes the windows which end at or before the watermark.
+func (w *Windows) expire(watermark int64) []*Window {
+	closed := []*Window{}
+	for start, g := range w.open {
+		if start+w.length <= watermark {
+			closed = append(closed, &Window{Start: start, End: start + w.length, Groups: g})
+			delete(w.open, start)
+		}
+	}
+	sort.Slice(closed, func(i, j int) bool { return closed[i].Start < closed[j].Start })
+	return closed
+}
+
+// last returns the start of the latest window containing t.
+func (w *Windows) last(t int64) int64 {
+	m := t % w.slide
+	if m < 0 {
+		m = m + w.slide
+	}
+	return t - m
+}
+
+// ActionWindow emits one record for each time window and group key with
+// the number of records.
+func ActionWindow(c *cli.Context) error {
+	tmpl, err := mustache.ParseString(c.String("time"))
+	if err != nil {
+		return fmt.Errorf("could not parse time template %q: %s", c.String("time"), err)
+	}
+	unit, ok := EPOCH_UNITS[c.String("epoch-unit")]
+	if !ok {
+		return fmt.Errorf("epoch unit must be s, ms, us or ns and not %q", c.String("epoch-unit"))
+	}
+	if c.Duration("window") == 0 {
+		return errors.New("--time requires --window")
+	}
+	slide := c.Duration("slide")
+	if slide == 0 {
+		slide = c.Duration("window")
+	}
+	keys := c.StringSlice("group-by")
+	w, err := NewWindows(c.Duration("window"), slide, c.Duration("lateness"), keys)
+	if err != nil {
+		return err
+	}
+	if err := checkSort(c.String("sort")); err != nil {
+		return err
+	}
+	emit := func(windows []*Window) error {
+		for _, win := range windows {
+			groups, err := win.Groups.Sorted(c.String("sort"), c.Int("top"))
+			if err != nil {
+				return err
+			}
+			for _, grp := range groups {
+				b := map[string]interface{}{}
+				b["start"] = time.Unix(0, win.Start).UTC().Format(time.RFC3339Nano)
+				b["end"] = time.Unix(0, win.End).UTC().Format(time.RFC3339Nano)
+				if len(keys) > 0 {
+					b[c.String("key-var")] = grp.Key
+				}
+				b[c.String("count-var")] = grp.Count
+				out, err := json.MarshalIndent(b, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Print(string(out))
+			}
+		}
+		return nil
+	}
+	i := 0
+	for x := range ReadJsonStream(os.Stdin) {
+		if x.Err != nil {
+			return x.Err
+		}
+		t, err := parseTime(tmpl.Render(false, x.Value), unit)
+		if err != nil {
+			return fmt.Errorf("record %d: %s", i, err)
+		}
+		if err := emit(w.Add(t, x.Value)); err != nil {
+			return err
+		}
+		i = i + 1
+	}
+	if err := emit(w.Flush()); err != nil {
+		return err
+	}
+	if w.late > 0 {
+		fmt.Fprintf(os.Stderr, "dropped %d late records\n", w.late)
+	}
+	return nil
+}
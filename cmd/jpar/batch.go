@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Default limit on the length of the arguments added to one batched
+// invocation.  It leaves plenty of room below ARG_MAX for the fixed
+// arguments and the environment.
+const DEFAULT_BATCH_BYTES = 128 * 1024
+
+// batchSize estimates the length of the arguments a record adds to a batch.
+// Worker variables are not known until the batch runs, so only the record
+// and its sequence number are available.
+func batchSize(params *Params, j Job) int {
+	vars := map[string]interface{}{"_jpar": map[string]interface{}{"seq": j.Seq}}
+	n := 0
+	for _, t := range params.BatchArgs {
+		// Each argument is terminated by a NUL.
+		n = n + len(t.Render(false, j.Value, vars)) + 1
+	}
+	return n
+}
+
+// buildBatchRun builds a single invocation for a batch of records.  The
+// command, environment and directory come from the first record, and each
+// record appends its batch arguments in order, like xargs.  The stdin of
+// the invocation is the concatenation of every record's stdin.
+func buildBatchRun(params *Params, batch []Job, jpar map[string]interface{}) *JobRun {
+	r := buildJobRun(params, batch[0].Value, jpar)
+	r.Expansions = nil
+	r.Batch = []interface{}{}
+	var last *StageRun
+	if len(r.Stages) > 0 {
+		last = r.Stages[len(r.Stages)-1]
+	}
+	stdin := []byte{}
+	for i, j := range batch {
+		v := map[string]interface{}{}
+		for k, x := range jpar {
+			v[k] = x
+		}
+		v["seq"] = j.Seq
+		vars := map[string]interface{}{"_jpar": v}
+		for _, t := range params.BatchArgs {
+			arg := t.Render(false, j.Value, vars)
+			*r.Cmd = append(*r.Cmd, arg)
+			if last != nil {
+				last.Cmd = append(last.Cmd, arg)
+			}
+		}
+		in := params.Stdin.Render(false, j.Value, vars)
+		if params.StdinBase64 {
+			b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(in))
+			// buildJobRun has already reported the first record.
+			if err != nil && i > 0 {
+				r.Errors = append(r.Errors, fmt.Sprintf("cannot decode stdin of record %d: %s", j.Seq, err))
+			}
+			stdin = append(stdin, b...)
+		} else {
+			stdin = append(stdin, in...)
+		}
+		r.Batch = append(r.Batch, j.Value)
+	}
+	if params.StdinBase64 {
+		r.Stdin = base64.StdEncoding.EncodeToString(stdin)
+	} else {
+		r.Stdin = string(stdin)
+	}
+	if len(r.Errors) != 0 {
+		r.Outcome = OUTCOME_FAILURE
+	}
+	return r
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// A Generator supplies the values of one variable.  Generated records
+// contain every combination of generator values.
+type Generator struct {
+	Name   string
+	Values []string
+}
+
+// parseGenerator reads a generator from argv starting at the variable
+// name, and returns the generator and the index of the next argument.
+//
+//	NAME ::: VALUE...    values run to the next --arg, -- or jpar option
+//	NAME :::: FILE       one value per line of FILE
+//
+// When none of those follows the last list, the command follows its values.
+// The command must start at the only value which names a program, and the
+// list is rejected as ambiguous when there is not exactly one.
+func parseGenerator(argv []string, i int) (Generator, int, error) {
+	if i+1 >= len(argv) {
+		return Generator{}, i, fmt.Errorf("--arg requires NAME ::: VALUE... or NAME :::: FILE")
+	}
+	g := Generator{Name: argv[i], Values: []string{}}
+	switch argv[i+1] {
+	case ":::":
+		i = i + 2
+		end := i
+		for end < len(argv) && argv[end] != "--arg" && argv[end] != "--" && !JPAR_OPTIONS[argv[end]] {
+			end = end + 1
+		}
+		if end == len(argv) {
+			programs := []int{}
+			for k := i; k < end; k = k + 1 {
+				if isProgram(argv[k]) {
+					programs = append(programs, k)
+				}
+			}
+			if len(programs) != 1 {
+				return g, i, fmt.Errorf("cannot tell where the values of --arg %s end and the command starts, put -- before the command", g.Name)
+			}
+			end = programs[0]
+		}
+		g.Values = append(g.Values, argv[i:end]...)
+		i = end
+	case "::::":
+		if i+2 >= len(argv) {
+			return g, i, fmt.Errorf("--arg %s :::: requires a file", g.Name)
+		}
+		values, err := readLines(argv[i+2])
+		if err != nil {
+			return g, i, err
+		}
+		g.Values = values
+		i = i + 3
+	default:
+		return g, i, fmt.Errorf("--arg %s must be followed by ::: or ::::", g.Name)
+	}
+	return g, i, nil
+}
+
+// isProgram reports whether s names an executable, either as a path or
+// through $PATH.
+func isProgram(s string) bool {
+	_, err := exec.LookPath(s)
+	return err == nil
+}
+
+func readLines(fn string) ([]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file %q for reading: %s", fn, err)
+	}
+	defer f.Close()
+	lines := []string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	return lines, s.Err()
+}
+
+// Generate produces the cartesian product of the generators as records.
+// The last generator varies fastest.
+func Generate(gens []Generator) chan JsonRead {
+	out := make(chan JsonRead)
+	go func() {
+		defer close(out)
+		for _, g := range gens {
+			if len(g.Values) == 0 {
+				return
+			}
+		}
+		idx := make([]int, len(gens))
+		for {
+			r := map[string]interface{}{}
+			for k, g := range gens {
+				r[g.Name] = g.Values[idx[k]]
+			}
+			out <- JsonRead{Value: r}
+			k := len(gens) - 1
+			for k >= 0 {
+				idx[k] = idx[k] + 1
+				if idx[k] < len(gens[k].Values) {
+					break
+				}
+				idx[k] = 0
+				k = k - 1
+			}
+			if k < 0 {
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bufio"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,7 +13,11 @@ import (
 	"os/exec"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/jmyounker/jtools/internal/mustache"
 )
@@ -23,6 +29,9 @@ const OUTCOME_SUCCESS string = "SUCCESS"
 const OUTCOME_FAILURE string = "FAILURE"
 
 func main() {
+	if len(os.Args) == 3 && os.Args[1] == SANDBOX_INIT {
+		sandboxInit(os.Args[2])
+	}
 	err := NewApp().Run(os.Args)
 	if err != nil {
 		fmt.Println(err)
@@ -30,22 +39,99 @@ func main() {
 	}
 }
 
+// The options which Run accepts.  A list of --arg values ends at any of
+// them.
+var JPAR_OPTIONS = map[string]bool{
+	"-p":                true,
+	"--parallelism":     true,
+	"-d":                true,
+	"--debug":           true,
+	"-v":                true,
+	"--version":         true,
+	"-h":                true,
+	"--help":            true,
+	"--dir":             true,
+	"-e":                true,
+	"--env":             true,
+	"-i":                true,
+	"--stdin":           true,
+	"--stdin-base64":    true,
+	"--status-socket":   true,
+	"--success-out":     true,
+	"--failures-out":    true,
+	"--output-template": true,
+	"--priority":        true,
+	"--lookahead":       true,
+	"--queue-dir":       true,
+	"--lease":           true,
+	"--feedback":        true,
+	"--max-depth":       true,
+	"--key":             true,
+	"--arg":             true,
+	"--worker-setup":    true,
+	"--worker-teardown": true,
+	"--tmpdir":          true,
+	"--stage":           true,
+	"--results":         true,
+	"--results-name":    true,
+	"--sandbox":         true,
+	"--bind":            true,
+	"--ro-bind":         true,
+	"--pty":             true,
+	"--pty-strip-ansi":  true,
+	"--pty-size":        true,
+	"--on-input-error":  true,
+	"--batch":           true,
+	"--batch-bytes":     true,
+	"--batch-arg":       true,
+}
+
 type App struct {
-	Prog        string
-	Parallelism int
-	Args        []string
-	Dir         string
-	Env         map[string]string
-	Stdin		string
+	Prog           string
+	Parallelism    int
+	Args           []string
+	Dir            string
+	Env            map[string]string
+	Stdin          string
+	StatusSocket   string
+	SuccessOut     string
+	FailuresOut    string
+	OutputTemplate string
+	Priority       string
+	Lookahead      int
+	QueueDir       string
+	Lease          time.Duration
+	Feedback       bool
+	MaxDepth       int
+	Key            string
+	Generators     []Generator
+	WorkerSetup    string
+	WorkerTeardown string
+	Tmpdir         bool
+	Stages         []string
+	Results        string
+	ResultsName    string
+	StdinBase64    bool
+	Sandbox        bool
+	Binds          []Bind
+	Pty            bool
+	PtyStripAnsi   bool
+	PtySize        string
+	OnInputError   string
+	Batch          int
+	BatchBytes     int
+	BatchArgs      []string
 }
 
 const DEFAULT_PARALLELISM = 8
 
 func NewApp() *App {
 	return &App{
-		Env:         map[string]string{},
-		Parallelism: DEFAULT_PARALLELISM,
-		Stdin:	     "{{stdout}}",
+		Env:          map[string]string{},
+		Parallelism:  DEFAULT_PARALLELISM,
+		Stdin:        "{{stdout}}",
+		Lease:        DEFAULT_LEASE,
+		OnInputError: INPUT_ERROR_STOP,
 	}
 }
 
@@ -53,6 +139,9 @@ func (a *App) Run(argv []string) error {
 	envPtrn := regexp.MustCompile("^([^=]+)=(.+)$")
 	args := []string{}
 	a.Prog = argv[0]
+	if len(argv) > 1 && argv[1] == "enqueue" {
+		return a.RunEnqueue(argv[2:])
+	}
 	i := 1
 	for i < len(argv) {
 		x := argv[i]
@@ -74,7 +163,8 @@ func (a *App) Run(argv []string) error {
 			return nil
 		case "-h", "--help":
 			i = i + 1
-			fmt.Printf("usage: %s [--parallelism N] [--debug] CMD\n", a.Prog)
+			fmt.Printf("usage: %s [--parallelism N] [--debug] [--stdin TEMPLATE [--stdin-base64]] [--status-socket PATH] [--success-out FILE] [--failures-out FILE] [--output-template TEMPLATE] [--priority TEMPLATE [--lookahead N]] [--queue-dir DIR [--lease DURATION]] [--feedback [--max-depth N] [--key TEMPLATE]] [--arg NAME ::: VALUE... | --arg NAME :::: FILE]... [--worker-setup CMD] [--worker-teardown CMD] [--tmpdir] [--stage STAGE]... [--results DIR [--results-name TEMPLATE]] [--sandbox [--bind SRC[:DST]]... [--ro-bind SRC[:DST]]...] [--pty [--pty-size COLSxROWS] [--pty-strip-ansi]] [--on-input-error skip|stop|emit] [--batch N] [--batch-bytes B] [--batch-arg TEMPLATE]... [--] [CMD]\n", a.Prog)
+			fmt.Printf("       %s enqueue --queue-dir DIR\n", a.Prog)
 			return nil
 		case "--dir":
 			i = i + 1
@@ -92,6 +182,145 @@ func (a *App) Run(argv []string) error {
 			i = i + 1
 			a.Stdin = argv[i]
 			i = i + 1
+		case "--stdin-base64":
+			i = i + 1
+			a.StdinBase64 = true
+		case "--status-socket":
+			i = i + 1
+			a.StatusSocket = argv[i]
+			i = i + 1
+		case "--success-out":
+			i = i + 1
+			a.SuccessOut = argv[i]
+			i = i + 1
+		case "--failures-out":
+			i = i + 1
+			a.FailuresOut = argv[i]
+			i = i + 1
+		case "--output-template":
+			i = i + 1
+			a.OutputTemplate = argv[i]
+			i = i + 1
+		case "--priority":
+			i = i + 1
+			a.Priority = argv[i]
+			i = i + 1
+		case "--lookahead":
+			i = i + 1
+			n, err := strconv.Atoi(argv[i])
+			if err != nil {
+				return err
+			}
+			a.Lookahead = n
+			i = i + 1
+		case "--queue-dir":
+			i = i + 1
+			a.QueueDir = argv[i]
+			i = i + 1
+		case "--lease":
+			i = i + 1
+			d, err := time.ParseDuration(argv[i])
+			if err != nil {
+				return err
+			}
+			a.Lease = d
+			i = i + 1
+		case "--feedback":
+			i = i + 1
+			a.Feedback = true
+		case "--max-depth":
+			i = i + 1
+			n, err := strconv.Atoi(argv[i])
+			if err != nil {
+				return err
+			}
+			a.MaxDepth = n
+			i = i + 1
+		case "--key":
+			i = i + 1
+			a.Key = argv[i]
+			i = i + 1
+		case "--arg":
+			g, next, err := parseGenerator(argv, i+1)
+			if err != nil {
+				return err
+			}
+			a.Generators = append(a.Generators, g)
+			i = next
+		case "--worker-setup":
+			i = i + 1
+			a.WorkerSetup = argv[i]
+			i = i + 1
+		case "--worker-teardown":
+			i = i + 1
+			a.WorkerTeardown = argv[i]
+			i = i + 1
+		case "--tmpdir":
+			i = i + 1
+			a.Tmpdir = true
+		case "--stage":
+			i = i + 1
+			a.Stages = append(a.Stages, argv[i])
+			i = i + 1
+		case "--results":
+			i = i + 1
+			a.Results = argv[i]
+			i = i + 1
+		case "--results-name":
+			i = i + 1
+			a.ResultsName = argv[i]
+			i = i + 1
+		case "--sandbox":
+			i = i + 1
+			a.Sandbox = true
+		case "--bind", "--ro-bind":
+			i = i + 1
+			b, err := parseBind(argv[i], x == "--ro-bind")
+			if err != nil {
+				return err
+			}
+			a.Binds = append(a.Binds, b)
+			i = i + 1
+		case "--pty":
+			i = i + 1
+			a.Pty = true
+		case "--pty-strip-ansi":
+			i = i + 1
+			a.PtyStripAnsi = true
+		case "--pty-size":
+			i = i + 1
+			a.PtySize = argv[i]
+			i = i + 1
+		case "--on-input-error":
+			i = i + 1
+			a.OnInputError = argv[i]
+			i = i + 1
+		case "--batch":
+			i = i + 1
+			n, err := strconv.Atoi(argv[i])
+			if err != nil {
+				return err
+			}
+			a.Batch = n
+			i = i + 1
+		case "--batch-bytes":
+			i = i + 1
+			n, err := strconv.Atoi(argv[i])
+			if err != nil {
+				return err
+			}
+			a.BatchBytes = n
+			i = i + 1
+		case "--batch-arg":
+			i = i + 1
+			a.BatchArgs = append(a.BatchArgs, argv[i])
+			i = i + 1
+		case "--":
+			i = i + 1
+			for i < len(argv) {
+				args = append(args, argv[i])
+				i = i + 1
+			}
 		default:
 			// The first unmatched argument to the end of argv is the the whole
 			// argument list.
@@ -102,19 +331,79 @@ func (a *App) Run(argv []string) error {
 		}
 	}
 	a.Args = args
-	if len(args) == 0 {
+	if len(args) == 0 && len(a.Stages) == 0 {
 		return errors.New("error: command required")
 	}
 	return ActionCmd(a)
 }
 
+// RunEnqueue adds the records on stdin to a queue directory.
+func (a *App) RunEnqueue(argv []string) error {
+	i := 0
+	for i < len(argv) {
+		switch argv[i] {
+		case "--queue-dir":
+			i = i + 1
+			a.QueueDir = argv[i]
+			i = i + 1
+		case "--on-input-error":
+			i = i + 1
+			a.OnInputError = argv[i]
+			i = i + 1
+		default:
+			return fmt.Errorf("unknown enqueue argument: %s", argv[i])
+		}
+	}
+	if a.QueueDir == "" {
+		return errors.New("error: --queue-dir required")
+	}
+	if err := checkInputErrorPolicy(a.OnInputError); err != nil {
+		return err
+	}
+	spool, err := NewSpool(a.QueueDir, a.Lease)
+	if err != nil {
+		return err
+	}
+	return spool.Enqueue(os.Stdin, a.OnInputError)
+}
+
+func checkInputErrorPolicy(policy string) error {
+	switch policy {
+	case INPUT_ERROR_SKIP, INPUT_ERROR_STOP, INPUT_ERROR_EMIT:
+		return nil
+	}
+	return fmt.Errorf("--on-input-error must be skip, stop or emit and not: %s", policy)
+}
+
+// inputError describes a record which could not be read.
+func inputError(x JsonRead) string {
+	if x.Offset != nil {
+		return fmt.Sprintf("parse error at byte %d: %s", *x.Offset, x.Err)
+	}
+	return fmt.Sprintf("parse error: %s", x.Err)
+}
+
 const RETURNCODE_FAILURE = -4242
 
 type Params struct {
-	Cmd []*mustache.Template
-	Env map[*mustache.Template]*mustache.Template
-	Dir *mustache.Template
-	Stdin *mustache.Template
+	Cmd         []*mustache.Template
+	Stages      [][]*mustache.Template // every stage of a pipeline, ending with Cmd
+	Env         map[*mustache.Template]*mustache.Template
+	Dir         *mustache.Template
+	Stdin       *mustache.Template
+	Priority    *mustache.Template
+	Key         *mustache.Template
+	Setup       *mustache.Template
+	Teardown    *mustache.Template
+	Tmpdir      bool
+	Results     *ResultsDirs
+	ResultsName *mustache.Template
+	StdinBase64 bool
+	Sandbox     *Sandbox
+	Pty         *Pty
+	Batch       int                  // records per batch, or 0 for no limit
+	BatchBytes  int                  // argument bytes per batch, or 0 when not batching
+	BatchArgs   []*mustache.Template // arguments added for each record of a batch
 }
 
 func ActionCmd(a *App) error {
@@ -122,28 +411,80 @@ func ActionCmd(a *App) error {
 	if err != nil {
 		return err
 	}
+	sinks, err := sinksFromApp(a)
+	if err != nil {
+		return err
+	}
+	defer sinks.Close()
 	jobs := make(chan Job)
 	results := make(chan Output)
 	inputDone := make(chan struct{})
 	workerDone := make(chan struct{})
 	outputDone := make(chan struct{})
+	status := NewStatus()
+	sched := newScheduler(a, params, results)
 	// Launch workers
-	for i := 0; i < a.Parallelism; i++ {
-		go worker(i, params, jobs, results, workerDone)
+	workers := &pool{
+		params:   params,
+		jobs:     jobs,
+		results:  results,
+		feedback: sched.feedback,
+		done:     workerDone,
+		status:   status,
+	}
+	workers.Resize(a.Parallelism)
+	if a.StatusSocket != "" {
+		stop, err := ServeStatus(a.StatusSocket, status, workers)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+	var spool *Spool
+	if a.QueueDir != "" {
+		spool, err = NewSpool(a.QueueDir, a.Lease)
+		if err != nil {
+			return err
+		}
 	}
 	// Send results to workers.
+	queue := make(chan Job)
 	go func() {
 		// Feed input to workers
-		j := ReadJsonStream(os.Stdin)
+		var j chan JsonRead
+		if spool != nil {
+			j = spool.Claims()
+		} else if len(a.Generators) > 0 {
+			j = Generate(a.Generators)
+		} else {
+			j = ReadJsonStream(os.Stdin, a.OnInputError != INPUT_ERROR_STOP)
+		}
 		for x := range j {
+			status.Read()
 			if x.Err == nil {
-				jobs <- Job{Value: x.Value}
-			} else {
-				r := NewJobRun(&[]string{}, "")
-				r.Errors = append(r.Errors, fmt.Sprintf("parse error: string(x.Err)"))
-				results <- Output{Value: r}
+				queue <- Job{Value: x.Value, Claim: x.Claim}
+				continue
+			}
+			r := NewJobRun(&[]string{}, "")
+			r.Errors = append(r.Errors, inputError(x))
+			r.Offset = x.Offset
+			if a.OnInputError != INPUT_ERROR_SKIP {
+				results <- Output{Value: r, Claim: x.Claim}
+				continue
+			}
+			log.Printf("skipping %s", inputError(x))
+			if x.Claim != "" {
+				// Store the failure so that the unreadable job is
+				// released rather than reclaimed by every process.
+				if err := spool.Complete(x.Claim, r); err != nil {
+					log.Printf("cannot store result for %s: %s", x.Claim, err)
+				}
 			}
 		}
+		close(queue)
+	}()
+	go func() {
+		sched.run(queue, jobs)
 		inputDone <- struct{}{}
 	}()
 	// Wait for input to complete.
@@ -155,12 +496,17 @@ func ActionCmd(a *App) error {
 				if !Debug {
 					x.Value.Expansions = nil
 					x.Value.Stdin = ""
+					x.Value.StdinEnc = ""
+				}
+				status.Record(x.Value)
+				if x.Claim != "" {
+					if err := spool.Complete(x.Claim, x.Value); err != nil {
+						log.Printf("cannot store result for %s: %s", x.Claim, err)
+					}
 				}
-				out, err := json.Marshal(x.Value)
-				if err != nil {
-					log.Panicf("Cannot marshal internal job record.")
+				if err := sinks.Write(x.Value); err != nil {
+					log.Panicf("Cannot write job record: %s", err)
 				}
-				os.Stdout.Write(out)
 			}
 		}
 		outputDone <- struct{}{}
@@ -168,28 +514,54 @@ func ActionCmd(a *App) error {
 	waitForTermination(inputDone, 1)
 	// Tell workers that there is no more work.  Workers will
 	// now quit.
-	for i := 0; i < a.Parallelism; i++ {
-		jobs <- Job{Done: true}
-	}
+	launched := workers.Close()
 	// Wait for workers to complete their current tasks.
-	waitForTermination(workerDone, a.Parallelism)
+	waitForTermination(workerDone, launched)
 	// Tell output routine that there is nothing left. Output
 	// routine will now quit.
 	results <- Output{Done: true}
-	return nil
+	waitForTermination(outputDone, 1)
+	return sinks.Close()
 }
 
 func paramsFromApp(a *App) (*Params, error) {
 	if a.Parallelism < 1 {
 		return nil, errors.New("at least one worker required")
 	}
-	cmd := []*mustache.Template{}
-	for _, arg := range a.Args {
-		t, err := mustache.ParseString(arg)
+	if err := checkInputErrorPolicy(a.OnInputError); err != nil {
+		return nil, err
+	}
+	if len(a.Generators) > 0 && a.QueueDir != "" {
+		return nil, errors.New("--arg cannot be used with --queue-dir")
+	}
+	stages := [][]*mustache.Template{}
+	for _, stage := range a.Stages {
+		words, err := splitWords(stage)
+		if err != nil {
+			return nil, err
+		}
+		if len(words) == 0 {
+			return nil, errors.New("stages cannot be empty")
+		}
+		st, err := parseArgs(words)
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, st)
+	}
+	if len(a.Args) > 0 {
+		cmd, err := parseArgs(a.Args)
 		if err != nil {
 			return nil, err
 		}
-		cmd = append(cmd, t)
+		stages = append(stages, cmd)
+	}
+	var cmd []*mustache.Template
+	if len(stages) > 0 {
+		cmd = stages[len(stages)-1]
+	}
+	if len(stages) < 2 {
+		stages = nil
 	}
 
 	env := map[*mustache.Template]*mustache.Template{}
@@ -215,7 +587,153 @@ func paramsFromApp(a *App) (*Params, error) {
 		return nil, fmt.Errorf("cannot parse stdin: %s", a.Stdin)
 	}
 
-	return &Params{cmd, env, dir, stdin}, nil
+	var priority *mustache.Template
+	if a.Priority != "" {
+		priority, err = mustache.ParseString(a.Priority)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse priority: %s", a.Priority)
+		}
+	} else if a.Lookahead != 0 {
+		return nil, errors.New("--lookahead requires --priority")
+	}
+	if a.Lookahead < 0 {
+		return nil, errors.New("lookahead cannot be negative")
+	}
+
+	var key *mustache.Template
+	if a.Key != "" {
+		key, err = mustache.ParseString(a.Key)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse key: %s", a.Key)
+		}
+	}
+	if a.MaxDepth < 0 {
+		return nil, errors.New("max depth cannot be negative")
+	}
+
+	var results *ResultsDirs
+	var resultsName *mustache.Template
+	if a.Results != "" {
+		results = NewResultsDirs(a.Results)
+		n := a.ResultsName
+		if n == "" && a.QueueDir != "" {
+			// Sequence numbers restart in every process sharing the queue.
+			n = DEFAULT_QUEUE_RESULTS_NAME
+		} else if n == "" {
+			n = DEFAULT_RESULTS_NAME
+		}
+		resultsName, err = mustache.ParseString(n)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse results name: %s", n)
+		}
+	} else if a.ResultsName != "" {
+		return nil, errors.New("--results-name requires --results")
+	}
+
+	var sandbox *Sandbox
+	if a.Sandbox {
+		if err := checkSandbox(); err != nil {
+			return nil, err
+		}
+		sandbox = &Sandbox{Binds: a.Binds}
+	} else if len(a.Binds) > 0 {
+		return nil, errors.New("--bind requires --sandbox")
+	}
+
+	var term *Pty
+	if a.Pty {
+		if len(stages) > 0 {
+			return nil, errors.New("--pty cannot be used with --stage")
+		}
+		term = &Pty{Cols: DEFAULT_PTY_COLS, Rows: DEFAULT_PTY_ROWS, StripAnsi: a.PtyStripAnsi}
+		if a.PtySize != "" {
+			term.Cols, term.Rows, err = parsePtySize(a.PtySize)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if a.PtyStripAnsi || a.PtySize != "" {
+		return nil, errors.New("--pty-size and --pty-strip-ansi require --pty")
+	}
+
+	var batchArgs []*mustache.Template
+	batchBytes := 0
+	if a.Batch < 0 || a.BatchBytes < 0 {
+		return nil, errors.New("batch limits cannot be negative")
+	}
+	if a.Batch > 0 || a.BatchBytes > 0 {
+		if a.QueueDir != "" {
+			return nil, errors.New("--batch cannot be used with --queue-dir")
+		}
+		batchBytes = a.BatchBytes
+		if batchBytes == 0 {
+			batchBytes = DEFAULT_BATCH_BYTES
+		}
+		if len(a.BatchArgs) > 0 {
+			batchArgs, err = parseArgs(a.BatchArgs)
+			if err != nil {
+				return nil, err
+			}
+		} else if len(cmd) > 1 {
+			// By default the last argument is added for each record.
+			batchArgs = []*mustache.Template{cmd[len(cmd)-1]}
+			cmd = cmd[:len(cmd)-1]
+			if len(stages) > 0 {
+				stages[len(stages)-1] = cmd
+			}
+		} else {
+			return nil, errors.New("--batch requires an argument for each record, either after the command or with --batch-arg")
+		}
+	} else if len(a.BatchArgs) > 0 {
+		return nil, errors.New("--batch-arg requires --batch or --batch-bytes")
+	}
+
+	var setup, teardown *mustache.Template
+	if a.WorkerSetup != "" {
+		setup, err = mustache.ParseString(a.WorkerSetup)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse worker setup: %s", a.WorkerSetup)
+		}
+	}
+	if a.WorkerTeardown != "" {
+		teardown, err = mustache.ParseString(a.WorkerTeardown)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse worker teardown: %s", a.WorkerTeardown)
+		}
+	}
+
+	return &Params{
+		Cmd:         cmd,
+		Stages:      stages,
+		Env:         env,
+		Dir:         dir,
+		Stdin:       stdin,
+		Priority:    priority,
+		Key:         key,
+		Setup:       setup,
+		Teardown:    teardown,
+		Tmpdir:      a.Tmpdir,
+		Results:     results,
+		ResultsName: resultsName,
+		StdinBase64: a.StdinBase64,
+		Sandbox:     sandbox,
+		Pty:         term,
+		Batch:       a.Batch,
+		BatchBytes:  batchBytes,
+		BatchArgs:   batchArgs,
+	}, nil
+}
+
+func parseArgs(args []string) ([]*mustache.Template, error) {
+	ts := []*mustache.Template{}
+	for _, arg := range args {
+		t, err := mustache.ParseString(arg)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
 }
 
 func waitForTermination(done chan struct{}, count int) {
@@ -228,23 +746,186 @@ func waitForTermination(done chan struct{}, count int) {
 	}
 }
 
-func worker(
-	id int,
-	p *Params,
-	jobs chan Job,
-	completed chan Output,
-	done chan struct{}) {
-	for job := range jobs {
+// pool manages the worker goroutines.  Its size can be changed while jobs
+// are running.
+type pool struct {
+	mu       sync.Mutex
+	params   *Params
+	jobs     chan Job
+	results  chan Output
+	feedback chan []Job // nil unless job output becomes new jobs
+	done     chan struct{}
+	status   *Status
+	size     int    // workers which have not been told to quit
+	launched int    // workers launched over the life of the pool
+	slots    []bool // slots held by running workers
+	closed   bool   // no more resizing once the pool is closing
+}
+
+// Resize grows or shrinks the pool to n workers.  Surplus workers quit
+// once they finish their current job.
+func (p *pool) Resize(n int) error {
+	if n < 1 {
+		return errors.New("at least one worker required")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.New("workers are shutting down")
+	}
+	for p.size < n {
+		go worker(p.launched, p.takeSlot(), p)
+		p.launched = p.launched + 1
+		p.size = p.size + 1
+	}
+	for p.size > n {
+		go func() { p.jobs <- Job{Done: true} }()
+		p.size = p.size - 1
+	}
+	return nil
+}
+
+// takeSlot returns the lowest slot which is not held by a worker.  The
+// caller must hold the lock.
+func (p *pool) takeSlot() int {
+	for i, held := range p.slots {
+		if !held {
+			p.slots[i] = true
+			return i
+		}
+	}
+	p.slots = append(p.slots, true)
+	return len(p.slots) - 1
+}
+
+func (p *pool) releaseSlot(slot int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.slots[slot] = false
+}
+
+func (p *pool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// Close tells the remaining workers to quit, and returns the number of
+// workers which will eventually report on the done channel.
+func (p *pool) Close() int {
+	p.mu.Lock()
+	p.closed = true
+	size := p.size
+	p.size = 0
+	launched := p.launched
+	p.mu.Unlock()
+	for i := 0; i < size; i++ {
+		p.jobs <- Job{Done: true}
+	}
+	return launched
+}
+
+func worker(id int, slot int, p *pool) {
+	p.runHook(id, HOOK_SETUP, p.params.Setup, workerVars(id, slot))
+	for job := range p.jobs {
 		if job.Done {
-			done <- struct{}{}
+			p.runHook(id, HOOK_TEARDOWN, p.params.Teardown, workerVars(id, slot))
+			p.releaseSlot(slot)
+			p.done <- struct{}{}
 			return
 		}
-		r := buildJobRun(p, job.Value)
-		r = runJob(r)
+		vars := workerVars(id, slot)
+		vars["seq"] = job.Seq
+		if job.Claim != "" {
+			vars["id"] = job.Claim
+		}
+		seq := job.Seq
+		tmp := ""
+		if p.params.Tmpdir {
+			dir, err := ioutil.TempDir("", "jpar-")
+			if err != nil {
+				r := NewJobRun(&[]string{}, job.Value)
+				r.Seq = &seq
+				r.Errors = append(r.Errors, fmt.Sprintf("cannot create scratch directory: %s", err))
+				p.results <- Output{Value: r, Claim: job.Claim}
+				if p.feedback != nil {
+					p.feedback <- []Job{}
+				}
+				continue
+			}
+			tmp = dir
+			vars["tmp"] = tmp
+		}
+		var r *JobRun
+		if job.Batch != nil {
+			r = buildBatchRun(p.params, job.Batch, vars)
+		} else {
+			r = buildJobRun(p.params, job.Value, vars)
+		}
+		r.Seq = &seq
+		r.Depth = job.Depth
+		if tmp != "" {
+			if r.Dir == "" {
+				r.Dir = tmp
+			}
+			if r.sandbox != nil {
+				r.sandbox = r.sandbox.With(tmp)
+			}
+		}
+		p.status.Begin(id, r)
+		r = runJob(r, func(pid int) { p.status.Launched(id, pid) })
+		p.status.End(id)
 		if Debug {
 			r.WorkerId = &id
 		}
-		completed <- Output{Value: r}
+		var children []Job
+		if p.feedback != nil {
+			children = feedbackJobs(r, job.Depth+1)
+		}
+		if tmp != "" {
+			// Scratch directories of failed jobs are kept for inspection.
+			if r.Failed() {
+				r.Tmpdir = tmp
+			} else {
+				os.RemoveAll(tmp)
+			}
+		}
+		if p.params.ResultsName != nil {
+			name := p.params.ResultsName.Render(false, job.Value, map[string]interface{}{"_jpar": vars})
+			dir, err := p.params.Results.Claim(name)
+			if err != nil {
+				r.Outcome = OUTCOME_FAILURE
+				r.Errors = append(r.Errors, err.Error())
+			} else if err := writeResults(dir, r); err != nil {
+				r.Outcome = OUTCOME_FAILURE
+				r.Errors = append(r.Errors, fmt.Sprintf("cannot write results to %s: %s", dir, err))
+			}
+		}
+		r.encodeOutput()
+		p.results <- Output{Value: r, Claim: job.Claim}
+		if p.feedback != nil {
+			p.feedback <- children
+		}
+	}
+}
+
+// feedbackJobs turns the stdout of a successful job into new jobs.
+func feedbackJobs(r *JobRun, depth int) []Job {
+	jobs := []Job{}
+	if r.Failed() {
+		return jobs
+	}
+	dec := json.NewDecoder(strings.NewReader(r.Stdout))
+	for {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			if err != io.EOF {
+				r.Outcome = OUTCOME_FAILURE
+				r.Errors = append(r.Errors, fmt.Sprintf("cannot parse feedback: %s", err))
+			}
+			return jobs
+		}
+		jobs = append(jobs, Job{Value: v, Depth: depth})
 	}
 }
 
@@ -255,12 +936,25 @@ type JobRun struct {
 	Dir        string             `json:"dir,omitempty"`
 	Expansions interface{}        `json:"e,omitempty"`
 	Returncode int                `json:"returncode"`
-	Stdin	   string          	  `json:"stdin,omitempty"`
+	Stdin      string             `json:"stdin,omitempty"`
+	StdinEnc   string             `json:"stdin_encoding,omitempty"`
+	Stages     []*StageRun        `json:"stages,omitempty"`
 	Stdout     string             `json:"stdout"`
+	StdoutEnc  string             `json:"stdout_encoding,omitempty"`
 	Stderr     string             `json:"stderr"`
+	StderrEnc  string             `json:"stderr_encoding,omitempty"`
 	Errors     []string           `json:"errors,omitempty"`
 	Outcome    string             `json:"outcome"`
+	Seq        *int               `json:"seq,omitempty"`
+	Depth      int                `json:"depth,omitempty"`
+	Tmpdir     string             `json:"tmpdir,omitempty"`
+	Results    string             `json:"results,omitempty"`
+	Hook       string             `json:"hook,omitempty"`
 	WorkerId   *int               `json:"worker-id,omitempty"`
+	Offset     *int64             `json:"input-offset,omitempty"`
+	Batch      []interface{}      `json:"batch,omitempty"`
+	sandbox    *Sandbox
+	pty        *Pty
 }
 
 func NewJobRun(cmd *[]string, e interface{}) *JobRun {
@@ -278,17 +972,94 @@ func NewJobRun(cmd *[]string, e interface{}) *JobRun {
 	}
 }
 
-func buildJobRun(params *Params, data interface{}) *JobRun {
+// Failed reports whether the job could not be run or exited unsuccessfully.
+func (r *JobRun) Failed() bool {
+	return r.Outcome != OUTCOME_SUCCESS || r.Returncode != 0
+}
+
+const HOOK_SETUP = "worker-setup"
+const HOOK_TEARDOWN = "worker-teardown"
+
+// runHook runs a worker setup or teardown command with sh.  Only failures
+// are reported.  The worker continues after a failed setup.
+func (p *pool) runHook(id int, hook string, t *mustache.Template, vars map[string]interface{}) {
+	if t == nil {
+		return
+	}
+	cmd := []string{"sh", "-c", t.Render(false, map[string]interface{}{"_jpar": vars})}
+	r := NewJobRun(&cmd, nil)
+	r.Outcome = OUTCOME_SUCCESS
+	r.Hook = hook
+	p.status.Begin(id, r)
+	r = runJob(r, func(pid int) { p.status.Launched(id, pid) })
+	p.status.End(id)
+	if Debug {
+		r.WorkerId = &id
+	}
+	r.encodeOutput()
+	if r.Failed() {
+		p.results <- Output{Value: r}
+	}
+}
+
+// workerVars are the values which jpar supplies to templates as
+// {{_jpar.NAME}}.  A record's own _jpar attribute hides them.
+func workerVars(worker int, slot int) map[string]interface{} {
+	return map[string]interface{}{
+		"worker": worker,
+		"slot":   slot,
+	}
+}
+
+// The encoding of output which is not valid UTF-8.
+const ENCODING_BASE64 = "base64"
+
+// encodeOutput base64 encodes output which JSON cannot carry because it is
+// not valid UTF-8.
+func (r *JobRun) encodeOutput() {
+	r.Stdout, r.StdoutEnc = encodeText(r.Stdout, r.StdoutEnc)
+	r.Stderr, r.StderrEnc = encodeText(r.Stderr, r.StderrEnc)
+	for _, s := range r.Stages {
+		s.Stderr, s.StderrEnc = encodeText(s.Stderr, s.StderrEnc)
+	}
+}
+
+func encodeText(s string, enc string) (string, string) {
+	if enc != "" || utf8.ValidString(s) {
+		return s, enc
+	}
+	return base64.StdEncoding.EncodeToString([]byte(s)), ENCODING_BASE64
+}
+
+// stdinBytes returns the job's stdin after decoding.
+func (r *JobRun) stdinBytes() ([]byte, error) {
+	if r.StdinEnc == ENCODING_BASE64 {
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(r.Stdin))
+	}
+	return []byte(r.Stdin), nil
+}
+
+func buildJobRun(params *Params, data interface{}, jpar map[string]interface{}) *JobRun {
+	vars := map[string]interface{}{"_jpar": jpar}
 	cmd := []string{}
 	for _, arg := range params.Cmd {
-		cmd = append(cmd, arg.Render(false, data))
+		cmd = append(cmd, arg.Render(false, data, vars))
 	}
 	r := NewJobRun(&cmd, data)
+	r.sandbox = params.Sandbox
+	r.pty = params.Pty
+	for _, stage := range params.Stages {
+		s := &StageRun{Cmd: []string{}}
+		for _, arg := range stage {
+			s.Cmd = append(s.Cmd, arg.Render(false, data, vars))
+		}
+		r.Stages = append(r.Stages, s)
+	}
 	if len(params.Env) > 0 {
 		env := map[string]string{}
 		for kt, vt := range params.Env {
-			k := kt.Render(false, data)
-			v := vt.Render(false, data)
+			k := kt.Render(false, data, vars)
+			v := vt.Render(false, data, vars)
 			_, ok := env[k]
 			if ok {
 				r.Errors = append(
@@ -301,10 +1072,16 @@ func buildJobRun(params *Params, data interface{}) *JobRun {
 		r.Env = &env
 	}
 	if params.Dir != nil {
-		r.Dir = params.Dir.Render(false, data)
+		r.Dir = params.Dir.Render(false, data, vars)
 	}
 
-	r.Stdin = params.Stdin.Render(false, data)
+	r.Stdin = params.Stdin.Render(false, data, vars)
+	if params.StdinBase64 {
+		r.StdinEnc = ENCODING_BASE64
+		if _, err := r.stdinBytes(); err != nil {
+			r.Errors = append(r.Errors, fmt.Sprintf("cannot decode stdin: %s", err))
+		}
+	}
 
 	if len(r.Errors) != 0 {
 		r.Outcome = OUTCOME_FAILURE
@@ -315,11 +1092,14 @@ func buildJobRun(params *Params, data interface{}) *JobRun {
 	return r
 }
 
-func runJob(r *JobRun) *JobRun {
+func runJob(r *JobRun, launched func(pid int)) *JobRun {
 	// If the outcome is already failure then there is nothing to do.
 	if r.Outcome == OUTCOME_FAILURE {
 		return r
 	}
+	if len(r.Stages) > 0 {
+		return runPipeline(r, launched)
+	}
 	cmd0 := (*r.Cmd)[0]
 	prog, err := exec.LookPath(cmd0)
 	if err != nil {
@@ -342,6 +1122,18 @@ func runJob(r *JobRun) *JobRun {
 	if r.Dir != "" {
 		c.Dir = r.Dir
 	}
+	if r.sandbox != nil {
+		done, err := r.sandbox.wrap(&c)
+		if err != nil {
+			r.Outcome = OUTCOME_FAILURE
+			r.Errors = append(r.Errors, err.Error())
+			return r
+		}
+		defer done()
+	}
+	if r.pty != nil {
+		return runPty(r, &c, launched)
+	}
 	outRdr, err := c.StdoutPipe()
 	if err != nil {
 		r.Outcome = OUTCOME_FAILURE
@@ -357,6 +1149,11 @@ func runJob(r *JobRun) *JobRun {
 		r.Outcome = OUTCOME_FAILURE
 		r.Errors = append(r.Errors, fmt.Sprintf("cannot construct stdin: %s", err))
 	}
+	in, err := r.stdinBytes()
+	if err != nil {
+		r.Outcome = OUTCOME_FAILURE
+		r.Errors = append(r.Errors, fmt.Sprintf("cannot decode stdin: %s", err))
+	}
 	if len(r.Errors) > 0 {
 		return r
 	}
@@ -366,10 +1163,11 @@ func runJob(r *JobRun) *JobRun {
 		r.Errors = append(r.Errors, fmt.Sprintf("failed to launch cmd: %s", err))
 		return r
 	}
+	launched(c.Process.Pid)
 	stdout := make(chan StringWithError)
 	stderr := make(chan StringWithError)
 	go func() {
-		stdin.Write([]byte(r.Stdin))
+		stdin.Write(in)
 		stdin.Close()
 	}()
 	go func() {
@@ -403,31 +1201,73 @@ func runJob(r *JobRun) *JobRun {
 	return r
 }
 
-func ReadJsonStream(stream *os.File) chan JsonRead {
-	dec := json.NewDecoder(stream)
+// How to handle input which cannot be parsed.
+const INPUT_ERROR_SKIP = "skip" // log the error and continue with the next line
+const INPUT_ERROR_STOP = "stop" // report the error and read no more input
+const INPUT_ERROR_EMIT = "emit" // report the error and continue with the next line
+
+// ReadJsonStream reads a stream of JSON values.  After a malformed value it
+// either stops or, when resync is set, discards the rest of the line and
+// carries on with the next one.  Error reads carry the byte offset at which
+// the malformed value starts.
+func ReadJsonStream(stream io.Reader, resync bool) chan JsonRead {
 	out := make(chan JsonRead)
-	var j interface{}
 	go func() {
+		defer close(out)
+		dec := json.NewDecoder(stream)
+		var base int64
 		for {
-			if err := dec.Decode(&j); err != nil {
-				if err == io.EOF {
-					close(out)
-					return
-				} else {
-					out <- JsonRead{nil, err}
-					close(out)
-					return
-				}
+			var j interface{}
+			err := dec.Decode(&j)
+			if err == io.EOF {
+				return
+			}
+			if err == nil {
+				out <- JsonRead{Value: j}
+				continue
+			}
+			// The decoder stops at the start of the malformed value, so the
+			// unread input begins there.
+			offset := base + dec.InputOffset()
+			rest := bufio.NewReader(io.MultiReader(dec.Buffered(), stream))
+			offset = offset + skipSpace(rest)
+			out <- JsonRead{Err: err, Offset: &offset}
+			if _, ok := err.(*json.SyntaxError); !ok || !resync {
+				return
+			}
+			line, err := rest.ReadBytes('\n')
+			if err != nil {
+				return
 			}
-			out <- JsonRead{j, nil}
+			base = offset + int64(len(line))
+			dec = json.NewDecoder(rest)
 		}
 	}()
 	return out
 }
 
+// skipSpace discards leading whitespace and returns the number of bytes
+// discarded.
+func skipSpace(r *bufio.Reader) int64 {
+	var n int64
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return n
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			r.UnreadByte()
+			return n
+		}
+		n = n + 1
+	}
+}
+
 type JsonRead struct {
-	Value interface{}
-	Err   error
+	Value  interface{}
+	Err    error
+	Offset *int64 // where a malformed value starts in the input
+	Claim  string // spooled job holding the record
 }
 
 type StringWithError struct {
@@ -436,11 +1276,18 @@ type StringWithError struct {
 }
 
 type Job struct {
-	Value interface{}
-	Done  bool
+	Value    interface{}
+	Seq      int
+	Priority float64
+	Depth    int
+	Claim    string
+	Batch    []Job // the records of a batch
+	Size     int   // argument bytes added to a batch
+	Done     bool
 }
 
 type Output struct {
 	Value *JobRun
+	Claim string
 	Done  bool
 }
@@ -1,10 +1,48 @@
 package main
 
 import (
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"fmt"
 	"github.com/jmyounker/jtools/internal/mustache"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
+func TestMain(m *testing.M) {
+	// Sandboxed jobs re-run the test binary as the sandbox init.
+	if len(os.Args) == 3 && os.Args[1] == SANDBOX_INIT {
+		sandboxInit(os.Args[2])
+	}
+	os.Exit(m.Run())
+}
+
+// runJobs runs the jobs one at a time on a pool of one worker, and returns
+// their job runs once the pool has shut down.
+func runJobs(params *Params, jobs ...Job) []*JobRun {
+	p := &pool{
+		params:  params,
+		jobs:    make(chan Job),
+		results: make(chan Output),
+		done:    make(chan struct{}),
+		status:  NewStatus(),
+	}
+	p.Resize(1)
+	runs := []*JobRun{}
+	for _, j := range jobs {
+		p.jobs <- j
+		runs = append(runs, (<-p.results).Value)
+	}
+	go p.Close()
+	<-p.done
+	return runs
+}
+
 func TestRender(t *testing.T) {
 	tmpl, err := mustache.ParseString("{{m}}{{p}}")
 	if err != nil {
@@ -16,3 +54,588 @@ func TestRender(t *testing.T) {
 		t.Fatalf("%s", e)
 	}
 }
+
+func TestStatusKeepsRecentFailures(t *testing.T) {
+	s := NewStatus()
+	for i := 0; i < RECENT_FAILURES+10; i++ {
+		r := NewJobRun(&[]string{"false"}, nil)
+		r.Outcome = OUTCOME_SUCCESS
+		r.Returncode = i
+		s.Record(r)
+	}
+	c := s.counters(1)
+	if c.Completed != RECENT_FAILURES+10 || c.Succeeded != 1 || c.Failed != RECENT_FAILURES+9 {
+		t.Fatalf("unexpected counters: %+v", c)
+	}
+	hook := NewJobRun(&[]string{"sh", "-c", "exit 3"}, nil)
+	hook.Hook = HOOK_SETUP
+	hook.Returncode = 3
+	s.Record(hook)
+	c = s.counters(1)
+	if c.Completed != RECENT_FAILURES+10 || c.HookFailures != 1 {
+		t.Fatalf("failed hook counted as a job: %+v", c)
+	}
+	f := s.recentFailures()
+	if len(f) != RECENT_FAILURES {
+		t.Fatalf("expected %d failures but got %d", RECENT_FAILURES, len(f))
+	}
+	if f[len(f)-2].Returncode != RECENT_FAILURES+9 || f[len(f)-1] != hook {
+		t.Fatalf("expected most recent failures last but got %d", f[len(f)-2].Returncode)
+	}
+}
+
+func TestSinksRouteByOutcome(t *testing.T) {
+	tmpl, err := mustache.ParseString("{{returncode}}:{{stdout}};")
+	if err != nil {
+		t.Fatal(err)
+	}
+	success := bytes.Buffer{}
+	failure := bytes.Buffer{}
+	s := &Sinks{Success: &success, Failure: &failure, Tmpl: tmpl}
+	for _, rc := range []int{0, 256, 0} {
+		r := NewJobRun(&[]string{"true"}, nil)
+		r.Outcome = OUTCOME_SUCCESS
+		r.Returncode = rc
+		r.Stdout = "x"
+		if err := s.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if success.String() != "0:x;0:x;" {
+		t.Fatalf("unexpected successes %q", success.String())
+	}
+	if failure.String() != "256:x;" {
+		t.Fatalf("unexpected failures %q", failure.String())
+	}
+}
+
+func TestJobHeapOrdersByPriorityThenSequence(t *testing.T) {
+	h := &jobHeap{}
+	for i, p := range []float64{1, 5, 1, 3, 5} {
+		heap.Push(h, Job{Seq: i, Priority: p})
+	}
+	want := []int{1, 4, 3, 0, 2}
+	for _, seq := range want {
+		j := heap.Pop(h).(Job)
+		if j.Seq != seq {
+			t.Fatalf("expected job %d but got %d", seq, j.Seq)
+		}
+	}
+}
+
+func TestSpoolReclaimsAbandonedJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jpar-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewSpool(dir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeFile(s.path("a", ".job"), []byte(`{"x":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.path("a", ".lock"), []byte{}, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if s.claim("a") {
+		t.Fatal("claimed a job with a live lease")
+	}
+	old := time.Now().Add(-2 * time.Minute)
+	os.Chtimes(s.path("a", ".lock"), old, old)
+	if !s.claim("a") {
+		t.Fatal("could not claim an abandoned job")
+	}
+	if err := s.Complete("a", NewJobRun(&[]string{"true"}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := s.pending()
+	if err != nil || len(ids) != 0 {
+		t.Fatalf("expected no pending jobs but got %v %v", ids, err)
+	}
+	if _, err := os.Stat(s.path("a", ".result")); err != nil {
+		t.Fatalf("expected a result: %s", err)
+	}
+}
+
+func TestSkippedSpoolJobIsReleased(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jpar-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewSpool(dir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeFile(s.path("a", ".job"), []byte(`{"x":`)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- NewApp().Run([]string{"jpar", "--queue-dir", dir, "--on-input-error", "skip", "true"})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("jpar kept holding the unreadable job")
+	}
+	ids, err := s.pending()
+	if err != nil || len(ids) != 0 {
+		t.Fatalf("expected no pending jobs but got %v %v", ids, err)
+	}
+	if _, err := os.Stat(s.path("a", ".result")); err != nil {
+		t.Fatalf("expected a result: %s", err)
+	}
+}
+
+func TestSpooledResultsAreNamedBySpoolID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jpar-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queue := filepath.Join(dir, "queue")
+	if err := os.Mkdir(queue, 0777); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSpool(queue, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if err := s.writeFile(s.path(id, ".job"), []byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results := filepath.Join(dir, "results")
+	err = NewApp().Run([]string{"jpar", "--queue-dir", s.Dir, "--results", results, "--success-out", filepath.Join(dir, "out"), "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, err := os.Stat(filepath.Join(results, id, "jobrun.json")); err != nil {
+			t.Fatalf("no results for spooled job %s: %s", id, err)
+		}
+	}
+}
+
+func TestSchedulerDropsDuplicateAndDeepJobs(t *testing.T) {
+	key, err := mustache.ParseString("{{d}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newScheduler(&App{Feedback: true, MaxDepth: 1}, &Params{Key: key}, nil)
+	r := NewJobRun(&[]string{"ls"}, nil)
+	r.Outcome = OUTCOME_SUCCESS
+	r.Returncode = 0
+	r.Stdout = `{"d":"a"} {"d":"b"} {"d":"a"}`
+	for _, j := range feedbackJobs(r, 1) {
+		s.admit(j)
+	}
+	s.admit(Job{Value: map[string]interface{}{"d": "c"}, Depth: 2})
+	if s.queue.Len() != 2 {
+		t.Fatalf("expected 2 queued jobs but got %d", s.queue.Len())
+	}
+}
+
+func TestGenerateCartesianProduct(t *testing.T) {
+	argv := []string{"--arg", "x", ":::", "a", "b", "--arg", "y", ":::", "1", "2", "3", "--", "echo"}
+	x, next, err := parseGenerator(argv, 1)
+	if err != nil || argv[next] != "--arg" {
+		t.Fatalf("cannot parse first generator: %v", err)
+	}
+	y, next, err := parseGenerator(argv, next+1)
+	if err != nil || argv[next] != "--" {
+		t.Fatalf("cannot parse second generator: %v", err)
+	}
+	gens := []Generator{x, y}
+	got := ""
+	for x := range Generate(gens) {
+		r := x.Value.(map[string]interface{})
+		got = got + r["x"].(string) + r["y"].(string) + " "
+	}
+	if got != "a1 a2 a3 b1 b2 b3 " {
+		t.Fatalf("unexpected records %q", got)
+	}
+}
+
+func TestGeneratorEndsWhereCommandStarts(t *testing.T) {
+	argv := []string{"--arg", "y", ":::", "1", "2", "echo", "{{y}}"}
+	y, next, err := parseGenerator(argv, 1)
+	if err != nil || next != 5 || strings.Join(y.Values, " ") != "1 2" {
+		t.Fatalf("unexpected generator %+v ending at %d: %v", y, next, err)
+	}
+	argv = []string{"--arg", "x", ":::", "a", "b", "-p", "2", "echo", "{{x}}"}
+	x, next, err := parseGenerator(argv, 1)
+	if err != nil || argv[next] != "-p" || strings.Join(x.Values, " ") != "a b" {
+		t.Fatalf("expected the values to end at an option: %+v %v", x, err)
+	}
+	argv = []string{"--arg", "mode", ":::", "fast", "test", "echo", "{{mode}}"}
+	if _, _, err := parseGenerator(argv, 1); err == nil {
+		t.Fatal("expected values holding a program name to be ambiguous")
+	}
+	a := NewApp()
+	a.Args = []string{"echo"}
+	a.Generators = []Generator{y}
+	a.QueueDir = "queue"
+	if _, err := paramsFromApp(a); err == nil {
+		t.Fatal("expected --arg with --queue-dir to fail")
+	}
+}
+
+func TestOnlyJobsCarrySequenceNumbers(t *testing.T) {
+	out, err := json.Marshal(NewJobRun(&[]string{}, nil))
+	if err != nil || strings.Contains(string(out), `"seq"`) {
+		t.Fatalf("record without a job has a sequence number: %s %v", out, err)
+	}
+	a := NewApp()
+	a.Args = []string{"true"}
+	params, err := paramsFromApp(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := runJobs(params, Job{Value: map[string]interface{}{}, Seq: 0})[0]
+	if r.Seq == nil || *r.Seq != 0 {
+		t.Fatalf("job 0 has sequence number %v", r.Seq)
+	}
+}
+
+func TestBuildJobRunExposesJparVars(t *testing.T) {
+	a := NewApp()
+	a.Args = []string{"echo", "{{x}}-{{_jpar.seq}}-{{_jpar.worker}}-{{_jpar.slot}}"}
+	a.Dir = "/tmp/{{_jpar.slot}}"
+	params, err := paramsFromApp(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := workerVars(3, 1)
+	vars["seq"] = 7
+	r := buildJobRun(params, map[string]interface{}{"x": "a"}, vars)
+	if (*r.Cmd)[1] != "a-7-3-1" {
+		t.Fatalf("unexpected argument %q", (*r.Cmd)[1])
+	}
+	if r.Dir != "/tmp/1" {
+		t.Fatalf("unexpected dir %q", r.Dir)
+	}
+}
+
+func TestWorkerKeepsScratchDirectoryOfFailedJobs(t *testing.T) {
+	a := NewApp()
+	a.Args = []string{"sh", "-c", "test -d {{_jpar.tmp}} && exit {{x}}"}
+	a.Tmpdir = true
+	params, err := paramsFromApp(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := runJobs(params,
+		Job{Value: map[string]interface{}{"x": "0"}},
+		Job{Value: map[string]interface{}{"x": "1"}})
+	if r := runs[0]; r.Failed() || r.Tmpdir != "" {
+		t.Fatalf("expected success without a kept directory: %+v", r)
+	}
+	r := runs[1]
+	if !r.Failed() || r.Tmpdir == "" {
+		t.Fatalf("expected failure with a kept directory: %+v", r)
+	}
+	if _, err := os.Stat(r.Tmpdir); err != nil {
+		t.Fatalf("scratch directory was not kept: %s", err)
+	}
+	os.RemoveAll(r.Tmpdir)
+}
+
+var splitWordsTests = []struct {
+	in   string
+	want []string
+}{
+	{"grep -v foo", []string{"grep", "-v", "foo"}},
+	{"  sort   -k2 ", []string{"sort", "-k2"}},
+	{`sh -c 'echo "{{x}}" | wc'`, []string{"sh", "-c", `echo "{{x}}" | wc`}},
+	{`grep "a b" c\ d`, []string{"grep", "a b", "c d"}},
+	{`echo ''`, []string{"echo", ""}},
+}
+
+func TestSplitWords(t *testing.T) {
+	for _, tc := range splitWordsTests {
+		got, err := splitWords(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, "|") != strings.Join(tc.want, "|") || len(got) != len(tc.want) {
+			t.Fatalf("splitting %q: expected %q but got %q", tc.in, tc.want, got)
+		}
+	}
+}
+
+func TestPipelineReportsEachStage(t *testing.T) {
+	a := NewApp()
+	a.Stages = []string{"echo {{x}}", "sh -c 'cat; echo err >&2; exit 2'"}
+	a.Args = []string{"tr", "a-z", "A-Z"}
+	params, err := paramsFromApp(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := buildJobRun(params, map[string]interface{}{"x": "abc"}, workerVars(0, 0))
+	r = runJob(r, func(int) {})
+	if r.Stdout != "ABC\n" {
+		t.Fatalf("unexpected stdout %q", r.Stdout)
+	}
+	if len(r.Stages) != 3 || r.Stages[1].Stderr != "err\n" || r.Stages[1].Returncode == 0 {
+		t.Fatalf("unexpected stages %+v", r.Stages)
+	}
+	if !r.Failed() {
+		t.Fatal("expected a failed middle stage to fail the job")
+	}
+}
+
+func TestWriteResultsLeavesOnlyPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jpar-results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := NewJobRun(&[]string{"echo", "it's"}, nil)
+	r.Stdout = "it's\n"
+	r.Stderr = "warning\n"
+	if err := writeResults(filepath.Join(dir, "0"), r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Stdout != "" || r.Stderr != "" || r.Results != filepath.Join(dir, "0") {
+		t.Fatalf("unexpected job run %+v", r)
+	}
+	for fn, want := range map[string]string{
+		"stdout": "it's\n",
+		"stderr": "warning\n",
+		"cmd":    "echo 'it'\\''s'\n",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, "0", fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("expected %s to contain %q but got %q", fn, want, got)
+		}
+	}
+}
+
+func TestResultsDirsStayInsideAndDoNotCollide(t *testing.T) {
+	rd := NewResultsDirs("/results")
+	for _, name := range []string{"", ".", "..", "../../tmp/escaped", "a/../../b", "/tmp/escaped"} {
+		if _, err := rd.Claim(name); err == nil {
+			t.Errorf("expected results name %q to be rejected", name)
+		}
+	}
+	dir, err := rd.Claim("a/./b")
+	if err != nil || dir != "/results/a/b" {
+		t.Fatalf("unexpected directory %q %v", dir, err)
+	}
+	if _, err := rd.Claim("a/b"); err == nil {
+		t.Fatal("expected a second job with the same name to be rejected")
+	}
+}
+
+func TestBinaryOutputIsBase64Encoded(t *testing.T) {
+	a := NewApp()
+	a.Args = []string{"cat"}
+	a.Stdin = "{{b}}"
+	a.StdinBase64 = true
+	params, err := paramsFromApp(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := buildJobRun(params, map[string]interface{}{"b": "AP8BAg=="}, workerVars(0, 0))
+	r = runJob(r, func(int) {})
+	if r.Stdout != "\x00\xff\x01\x02" {
+		t.Fatalf("unexpected stdout %q", r.Stdout)
+	}
+	r.encodeOutput()
+	if r.Stdout != "AP8BAg==" || r.StdoutEnc != ENCODING_BASE64 || r.StderrEnc != "" {
+		t.Fatalf("unexpected encoding %q %q %q", r.Stdout, r.StdoutEnc, r.StderrEnc)
+	}
+}
+
+func TestParseBind(t *testing.T) {
+	b, err := parseBind("/tmp", true)
+	if err != nil || b.Src != "/tmp" || b.Dst != "/tmp" || !b.ReadOnly {
+		t.Fatalf("unexpected bind %+v %v", b, err)
+	}
+	b, err = parseBind("/tmp:/scratch", false)
+	if err != nil || b.Src != "/tmp" || b.Dst != "/scratch" || b.ReadOnly {
+		t.Fatalf("unexpected bind %+v %v", b, err)
+	}
+	if _, err := parseBind("/tmp:scratch", false); err == nil {
+		t.Fatal("expected relative destination to fail")
+	}
+	if _, err := parseBind("/nonexistent/jpar", false); err == nil {
+		t.Fatal("expected missing source to fail")
+	}
+}
+
+func TestSandboxedJobRunsInScratchDirectory(t *testing.T) {
+	if err := checkSandbox(); err != nil {
+		t.Skip(err)
+	}
+	a := NewApp()
+	a.Args = []string{"/bin/sh", "-c", "pwd && touch out && ls /tmp"}
+	a.Sandbox = true
+	for _, p := range []string{"/usr", "/bin", "/lib", "/lib64"} {
+		if _, err := os.Stat(p); err == nil {
+			a.Binds = append(a.Binds, Bind{Src: p, Dst: p, ReadOnly: true})
+		}
+	}
+	a.Tmpdir = true
+	params, err := paramsFromApp(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := runJobs(params, Job{Value: map[string]interface{}{}})[0]
+	if r.Failed() {
+		t.Fatalf("sandboxed job failed: %d %q %v", r.Returncode, r.Stderr, r.Errors)
+	}
+	lines := strings.Split(strings.TrimSpace(r.Stdout), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], filepath.Join(os.TempDir(), "jpar-")) {
+		t.Fatalf("unexpected output %q", r.Stdout)
+	}
+	// Only the scratch directory is visible in the private /tmp.
+	if filepath.Dir(lines[0]) == "/tmp" && lines[1] != filepath.Base(lines[0]) {
+		t.Fatalf("unexpected /tmp contents %q", lines[1])
+	}
+}
+
+func TestSandboxedJobCannotRemountReadOnlyBind(t *testing.T) {
+	if err := checkSandbox(); err != nil {
+		t.Skip(err)
+	}
+	dir, err := ioutil.TempDir("", "jpar-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := NewApp()
+	a.Args = []string{"/bin/sh", "-c", "mount -o remount,bind,rw " + dir + "; touch " + dir + "/out"}
+	a.Sandbox = true
+	for _, p := range []string{"/usr", "/bin", "/lib", "/lib64"} {
+		if _, err := os.Stat(p); err == nil {
+			a.Binds = append(a.Binds, Bind{Src: p, Dst: p, ReadOnly: true})
+		}
+	}
+	a.Binds = append(a.Binds, Bind{Src: dir, Dst: dir, ReadOnly: true})
+	params, err := paramsFromApp(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := runJobs(params, Job{Value: map[string]interface{}{}})[0]
+	if !r.Failed() {
+		t.Fatalf("expected the write to fail: %q", r.Stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out")); err == nil {
+		t.Fatal("sandboxed job wrote to a read-only bind")
+	}
+}
+
+func TestPtyJobSeesTerminal(t *testing.T) {
+	a := NewApp()
+	a.Args = []string{"sh", "-c", "test -t 1 && stty size && printf '\\033[1mbold\\033[0m' >&2"}
+	a.Pty = true
+	a.PtySize = "100x30"
+	a.PtyStripAnsi = true
+	params, err := paramsFromApp(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := buildJobRun(params, map[string]interface{}{}, workerVars(0, 0))
+	r = runJob(r, func(int) {})
+	if r.Outcome != OUTCOME_SUCCESS || r.Returncode != 0 {
+		t.Fatalf("job failed %v %d %v", r.Outcome, r.Returncode, r.Errors)
+	}
+	if r.Stdout != "30 100\r\nbold" || r.Stderr != "" {
+		t.Fatalf("unexpected output %q %q", r.Stdout, r.Stderr)
+	}
+}
+
+func TestPtyJobStdinPassesThrough(t *testing.T) {
+	a := NewApp()
+	a.Args = []string{"cat"}
+	a.Stdin = "{{in}}"
+	a.Pty = true
+	params, err := paramsFromApp(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for in, want := range map[string]string{
+		"hello":            "hello",
+		"ab\x03c\rd\x7f\n": "ab\x03c\rd\x7f\r\n",
+	} {
+		r := buildJobRun(params, map[string]interface{}{"in": in}, workerVars(0, 0))
+		r = runJob(r, func(int) {})
+		if r.Outcome != OUTCOME_SUCCESS || r.Returncode != 0 || r.Stdout != want {
+			t.Fatalf("unexpected output %v %d %q %v", r.Outcome, r.Returncode, r.Stdout, r.Errors)
+		}
+	}
+	for _, in := range []string{"a\x04b", strings.Repeat("x", PTY_MAX_LINE+1)} {
+		r := buildJobRun(params, map[string]interface{}{"in": in}, workerVars(0, 0))
+		r = runJob(r, func(int) {})
+		if !r.Failed() || len(r.Errors) != 1 {
+			t.Fatalf("expected stdin %.20q to be rejected: %v", in, r.Errors)
+		}
+	}
+}
+
+func TestReadJsonStreamResynchronises(t *testing.T) {
+	in := "{\"a\":1}\n{\"a\":,}\n  {\"a\":3}\n"
+	got := []string{}
+	for x := range ReadJsonStream(strings.NewReader(in), true) {
+		if x.Err != nil {
+			got = append(got, inputError(x))
+		} else {
+			got = append(got, fmt.Sprint(x.Value.(map[string]interface{})["a"]))
+		}
+	}
+	if len(got) != 3 || got[0] != "1" || !strings.HasPrefix(got[1], "parse error at byte 8: ") || got[2] != "3" {
+		t.Fatalf("unexpected reads %q", got)
+	}
+	n := 0
+	for range ReadJsonStream(strings.NewReader(in), false) {
+		n = n + 1
+	}
+	if n != 2 {
+		t.Fatalf("expected reading to stop after the error but got %d reads", n)
+	}
+}
+
+func TestSchedulerSendsBatches(t *testing.T) {
+	a := NewApp()
+	a.Args = []string{"rm", "-f", "{{f}}"}
+	a.Batch = 3
+	a.BatchBytes = 8
+	params, err := paramsFromApp(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newScheduler(a, params, nil)
+	in := make(chan Job)
+	out := make(chan Job)
+	go func() {
+		for _, f := range []string{"a", "b", "c", "d", "eeeeee", "f"} {
+			in <- Job{Value: map[string]interface{}{"f": f}}
+		}
+		close(in)
+	}()
+	go func() {
+		s.run(in, out)
+		close(out)
+	}()
+	got := []string{}
+	for j := range out {
+		r := buildBatchRun(params, j.Batch, workerVars(0, 0))
+		got = append(got, strings.Join(*r.Cmd, " "))
+	}
+	want := []string{"rm -f a b c", "rm -f d", "rm -f eeeeee", "rm -f f"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("expected batches %q but got %q", want, got)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/creack/pty"
+)
+
+const DEFAULT_PTY_COLS = 80
+const DEFAULT_PTY_ROWS = 24
+
+// Pty describes the terminal which jobs are attached to.
+type Pty struct {
+	Cols      uint16
+	Rows      uint16
+	StripAnsi bool
+}
+
+// parsePtySize parses COLSxROWS.
+func parsePtySize(s string) (uint16, uint16, error) {
+	parts := strings.SplitN(s, "x", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("terminal size must have the format COLSxROWS and not: %s", s)
+	}
+	cols, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil || cols == 0 {
+		return 0, 0, fmt.Errorf("bad terminal width: %s", parts[0])
+	}
+	rows, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil || rows == 0 {
+		return 0, 0, fmt.Errorf("bad terminal height: %s", parts[1])
+	}
+	return uint16(cols), uint16(rows), nil
+}
+
+// runPty runs c attached to a new pseudo-terminal.  Everything the job
+// writes to the terminal becomes its stdout.  The job's stdin is typed into
+// the terminal, with echo turned off, followed by an end-of-file.
+func runPty(r *JobRun, c *exec.Cmd, launched func(pid int)) *JobRun {
+	in, err := r.stdinBytes()
+	if err != nil {
+		r.Outcome = OUTCOME_FAILURE
+		r.Errors = append(r.Errors, fmt.Sprintf("cannot decode stdin: %s", err))
+		return r
+	}
+	if err := checkPtyInput(in); err != nil {
+		r.Outcome = OUTCOME_FAILURE
+		r.Errors = append(r.Errors, err.Error())
+		return r
+	}
+	term, tty, err := pty.Open()
+	if err != nil {
+		r.Outcome = OUTCOME_FAILURE
+		r.Errors = append(r.Errors, fmt.Sprintf("cannot open terminal: %s", err))
+		return r
+	}
+	defer term.Close()
+	err = pty.Setsize(term, &pty.Winsize{Cols: r.pty.Cols, Rows: r.pty.Rows})
+	if err == nil {
+		err = configureTerminal(tty)
+	}
+	if err != nil {
+		tty.Close()
+		r.Outcome = OUTCOME_FAILURE
+		r.Errors = append(r.Errors, fmt.Sprintf("cannot set up terminal: %s", err))
+		return r
+	}
+	c.Stdin = tty
+	c.Stdout = tty
+	c.Stderr = tty
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	// The terminal becomes the controlling terminal of a new session.
+	c.SysProcAttr.Setsid = true
+	c.SysProcAttr.Setctty = true
+	err = c.Start()
+	// Only the job holds the terminal open now, so reads end when it exits.
+	tty.Close()
+	if err != nil {
+		r.Outcome = OUTCOME_FAILURE
+		r.Errors = append(r.Errors, fmt.Sprintf("failed to launch cmd: %s", err))
+		return r
+	}
+	launched(c.Process.Pid)
+	go func() {
+		term.Write(in)
+		if len(in) > 0 && in[len(in)-1] != '\n' {
+			// The first end-of-file only ends the partial line.
+			term.Write([]byte{4})
+		}
+		term.Write([]byte{4})
+	}()
+	out := bytes.Buffer{}
+	_, err = io.Copy(&out, term)
+	if err != nil && !isPtyClosed(err) {
+		r.Outcome = OUTCOME_FAILURE
+		r.Errors = append(r.Errors, fmt.Sprintf("stdout: %s", err))
+	}
+	c.Wait()
+	stat := c.ProcessState.Sys().(syscall.WaitStatus)
+	r.Returncode = int(uint32(stat))
+	r.Stdout = out.String()
+	if r.pty.StripAnsi {
+		r.Stdout = stripAnsi(r.Stdout)
+	}
+	if len(r.Errors) == 0 {
+		r.Outcome = OUTCOME_SUCCESS
+	}
+	return r
+}
+
+// configureTerminal makes the terminal pass the job's stdin through as it
+// was given.  Echo, signal characters, flow control, line editing and
+// carriage return translation are turned off.  Canonical mode stays on, so
+// that the end-of-file character can end the input.
+func configureTerminal(tty *os.File) error {
+	t := syscall.Termios{}
+	if err := getTermios(tty, &t); err != nil {
+		return err
+	}
+	t.Lflag = t.Lflag &^ (syscall.ECHO | syscall.ISIG | syscall.IEXTEN)
+	t.Iflag = t.Iflag &^ (syscall.IXON | syscall.ICRNL | syscall.INLCR | syscall.IGNCR)
+	t.Cc[syscall.VERASE] = 0
+	t.Cc[syscall.VKILL] = 0
+	return setTermios(tty, &t)
+}
+
+// checkPtyInput rejects stdin which cannot pass through a terminal in
+// canonical mode: the end-of-file character, and lines which are longer
+// than the terminal's line buffer, which it would truncate.
+func checkPtyInput(in []byte) error {
+	if bytes.IndexByte(in, 4) >= 0 {
+		return errors.New("stdin for a terminal cannot contain the end-of-file character ^D")
+	}
+	for _, line := range bytes.Split(in, []byte{'\n'}) {
+		if len(line) > PTY_MAX_LINE {
+			return fmt.Errorf("stdin for a terminal cannot have lines longer than %d bytes", PTY_MAX_LINE)
+		}
+	}
+	return nil
+}
+
+// isPtyClosed reports whether a read failed because every process on the
+// terminal has closed it.  Linux reports this as EIO rather than as EOF.
+func isPtyClosed(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.EIO
+}
+
+var ansiSequence = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[@-Z\\-_])`)
+
+// stripAnsi removes terminal control sequences such as colors and cursor
+// movement.
+func stripAnsi(s string) string {
+	return ansiSequence.ReplaceAllString(s, "")
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// The longest line which the terminal accepts in canonical mode.  Linux
+// keeps one byte of its 4096 byte buffer for the newline.
+const PTY_MAX_LINE = 4095
+
+func getTermios(tty *os.File, t *syscall.Termios) error {
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(t))); e != 0 {
+		return e
+	}
+	return nil
+}
+
+func setTermios(tty *os.File, t *syscall.Termios) error {
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(t))); e != 0 {
+		return e
+	}
+	return nil
+}
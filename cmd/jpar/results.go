@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Default name of a job's directory within the results directory.
+const DEFAULT_RESULTS_NAME = "{{_jpar.seq}}"
+
+// Default name with --queue-dir, where jobs are named by their spool ID,
+// which is unique across every process sharing the queue.
+const DEFAULT_QUEUE_RESULTS_NAME = "{{_jpar.id}}"
+
+// ResultsDirs hands out the jobs' directories within the results
+// directory.  Names come from record data, so they must stay inside the
+// results directory, and each may be used by only one job of a run.
+type ResultsDirs struct {
+	root string
+	mu   sync.Mutex
+	used map[string]bool
+}
+
+func NewResultsDirs(root string) *ResultsDirs {
+	return &ResultsDirs{root: root, used: map[string]bool{}}
+}
+
+// Claim returns the directory for a job's results name.
+func (rd *ResultsDirs) Claim(name string) (string, error) {
+	clean := filepath.Clean(name)
+	if name == "" || filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("results name %q must be a relative path within %s", name, rd.root)
+	}
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if rd.used[clean] {
+		return "", fmt.Errorf("results name %q is already used by another job", name)
+	}
+	rd.used[clean] = true
+	return filepath.Join(rd.root, clean), nil
+}
+
+// writeResults stores a job's output in dir, and then removes the output
+// from the job run so that it carries only the directory's path.
+//
+//	dir/stdout        the job's stdout
+//	dir/stderr        the job's stderr
+//	dir/cmd           the command as a shell would run it
+//	dir/jobrun.json   the complete job run
+func writeResults(dir string, r *JobRun) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	// The output files hold the output as it was produced.
+	files := []struct {
+		name string
+		data string
+	}{
+		{"stdout", r.Stdout},
+		{"stderr", r.Stderr},
+		{"cmd", commandLine(r) + "\n"},
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f.name), []byte(f.data), 0666); err != nil {
+			return err
+		}
+	}
+	r.encodeOutput()
+	run, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "jobrun.json"), run, 0666); err != nil {
+		return err
+	}
+	r.Results = dir
+	r.Stdout, r.StdoutEnc = "", ""
+	r.Stderr, r.StderrEnc = "", ""
+	for _, s := range r.Stages {
+		s.Stderr, s.StderrEnc = "", ""
+	}
+	return nil
+}
+
+// commandLine renders the job's command, or its pipeline, for a shell.
+func commandLine(r *JobRun) string {
+	if len(r.Stages) == 0 {
+		return shellQuote(*r.Cmd)
+	}
+	stages := []string{}
+	for _, s := range r.Stages {
+		stages = append(stages, shellQuote(s.Cmd))
+	}
+	return strings.Join(stages, " | ")
+}
+
+var shellSafe = regexp.MustCompile(`^[-A-Za-z0-9_./=:,+@%]+$`)
+
+func shellQuote(args []string) string {
+	quoted := []string{}
+	for _, arg := range args {
+		if shellSafe.MatchString(arg) {
+			quoted = append(quoted, arg)
+		} else {
+			quoted = append(quoted, fmt.Sprintf("'%s'", strings.Replace(arg, "'", `'\''`, -1)))
+		}
+	}
+	return strings.Join(quoted, " ")
+}
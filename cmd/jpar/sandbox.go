@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The hidden command which sets up a sandbox and then runs the job.
+const SANDBOX_INIT = "__sandbox-init"
+
+// A Sandbox describes the isolated environment a job runs in: fresh user,
+// mount and network namespaces with an empty root file system containing
+// only the bound paths and a private /tmp.
+type Sandbox struct {
+	Binds []Bind
+}
+
+// A Bind makes a path from the host visible inside the sandbox.
+type Bind struct {
+	Src      string `json:"src"`
+	Dst      string `json:"dst"`
+	ReadOnly bool   `json:"ro,omitempty"`
+}
+
+// sandboxConfig is passed to the sandbox init.
+type sandboxConfig struct {
+	Root  string   `json:"root"`
+	Binds []Bind   `json:"binds"`
+	Dir   string   `json:"dir,omitempty"`
+	Prog  string   `json:"prog"`
+	Args  []string `json:"args"`
+}
+
+// parseBind parses SRC[:DST].  The destination defaults to the source.
+func parseBind(s string, readOnly bool) (Bind, error) {
+	parts := strings.SplitN(s, ":", 2)
+	src, err := filepath.Abs(parts[0])
+	if err != nil {
+		return Bind{}, err
+	}
+	if _, err := os.Stat(src); err != nil {
+		return Bind{}, fmt.Errorf("cannot bind %s: %s", s, err)
+	}
+	dst := src
+	if len(parts) == 2 {
+		if !filepath.IsAbs(parts[1]) {
+			return Bind{}, fmt.Errorf("bind destination must be absolute: %s", s)
+		}
+		dst = filepath.Clean(parts[1])
+	}
+	return Bind{Src: src, Dst: dst, ReadOnly: readOnly}, nil
+}
+
+// With returns a copy of the sandbox with an additional writable path.
+func (sb *Sandbox) With(path string) *Sandbox {
+	binds := append([]Bind{}, sb.Binds...)
+	binds = append(binds, Bind{Src: path, Dst: path})
+	return &Sandbox{Binds: binds}
+}
+
+// wrap changes c so that it runs inside the sandbox.  The returned
+// function must be called once c has completed.
+func (sb *Sandbox) wrap(c *exec.Cmd) (func(), error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("cannot locate jpar for sandbox: %s", err)
+	}
+	root, err := ioutil.TempDir("", "jpar-sandbox-")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create sandbox root: %s", err)
+	}
+	conf, err := json.Marshal(sandboxConfig{
+		Root:  root,
+		Binds: sb.Binds,
+		Dir:   c.Dir,
+		Prog:  c.Path,
+		Args:  c.Args,
+	})
+	if err != nil {
+		os.Remove(root)
+		return nil, err
+	}
+	c.Path = self
+	c.Args = []string{"jpar", SANDBOX_INIT, string(conf)}
+	c.Dir = ""
+	c.SysProcAttr = sandboxAttr()
+	return func() { os.Remove(root) }, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const SANDBOX_CLONEFLAGS = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET
+
+const (
+	PR_SET_NO_NEW_PRIVS = 38
+	CAP_VERSION_3       = 0x20080522
+)
+
+// sandboxAttr maps the current user to root inside the new namespaces, which
+// gives the sandbox init enough privilege to build the file system.
+func sandboxAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Cloneflags: SANDBOX_CLONEFLAGS,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+		GidMappingsEnableSetgroups: false,
+		Pdeathsig:                  syscall.SIGKILL,
+	}
+}
+
+// checkSandbox verifies that sandboxes can be created by creating an empty
+// one.
+func checkSandbox() error {
+	sb := &Sandbox{}
+	c := &exec.Cmd{}
+	done, err := sb.wrap(c)
+	if err != nil {
+		return err
+	}
+	defer done()
+	out := bytes.Buffer{}
+	c.Stderr = &out
+	if err := c.Run(); err != nil {
+		msg := strings.TrimSpace(out.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return fmt.Errorf("cannot create sandbox, unprivileged user namespaces may be disabled: %s", msg)
+	}
+	return nil
+}
+
+// sandboxInit runs inside the new namespaces.  It builds the sandbox's file
+// system and then replaces itself with the job.  It never returns.
+func sandboxInit(arg string) {
+	// Capabilities belong to threads, so the job must be started from the
+	// thread which dropped them.
+	runtime.LockOSThread()
+	conf := sandboxConfig{}
+	if err := json.Unmarshal([]byte(arg), &conf); err != nil {
+		sandboxFail("cannot parse sandbox config: %s", err)
+	}
+	if err := buildSandbox(&conf); err != nil {
+		sandboxFail("%s", err)
+	}
+	if err := dropPrivileges(); err != nil {
+		sandboxFail("%s", err)
+	}
+	if conf.Prog == "" {
+		os.Exit(0)
+	}
+	env := os.Environ()
+	if err := syscall.Exec(conf.Prog, conf.Args, env); err != nil {
+		sandboxFail("cannot run %s in sandbox: %s", conf.Prog, err)
+	}
+}
+
+func sandboxFail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "jpar sandbox: "+format+"\n", args...)
+	os.Exit(127)
+}
+
+func buildSandbox(conf *sandboxConfig) error {
+	// Keep the sandbox's mounts from propagating back to the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("cannot make mounts private: %s", err)
+	}
+	root := conf.Root
+	if err := syscall.Mount("tmpfs", root, "tmpfs", 0, "mode=0755"); err != nil {
+		return fmt.Errorf("cannot mount sandbox root: %s", err)
+	}
+	// The private /tmp comes first so that binds beneath it, such as the
+	// job's scratch directory, are mounted on top of it rather than hidden.
+	tmp := filepath.Join(root, "tmp")
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", tmp, "tmpfs", 0, "mode=1777"); err != nil {
+		return fmt.Errorf("cannot mount private /tmp: %s", err)
+	}
+	for _, b := range conf.Binds {
+		if err := bindMount(root, b); err != nil {
+			return err
+		}
+	}
+	old := filepath.Join(root, ".oldroot")
+	if err := os.Mkdir(old, 0700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(root, old); err != nil {
+		return fmt.Errorf("cannot change root: %s", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.oldroot", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("cannot detach host file system: %s", err)
+	}
+	os.Remove("/.oldroot")
+	if conf.Dir != "" {
+		if err := syscall.Chdir(conf.Dir); err != nil {
+			return fmt.Errorf("cannot change to %s, it must be bound into the sandbox: %s", conf.Dir, err)
+		}
+	}
+	return nil
+}
+
+// dropPrivileges removes every capability which the sandbox init holds
+// as root in its user namespace.  Without them the job cannot remount its
+// read-only binds, and as it still runs as root the bounding set must be
+// emptied too, or exec would hand them back.
+func dropPrivileges() error {
+	for c := uintptr(0); ; c = c + 1 {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, c, 0)
+		if errno == syscall.EINVAL {
+			break
+		}
+		if errno != 0 {
+			return fmt.Errorf("cannot drop capability %d: %s", c, errno)
+		}
+	}
+	hdr := struct {
+		version uint32
+		pid     int32
+	}{version: CAP_VERSION_3}
+	data := [2]struct {
+		effective   uint32
+		permitted   uint32
+		inheritable uint32
+	}{}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("cannot drop capabilities: %s", errno)
+	}
+	_, _, errno = syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_NO_NEW_PRIVS, 1, 0)
+	if errno != 0 {
+		return fmt.Errorf("cannot forbid new privileges: %s", errno)
+	}
+	return nil
+}
+
+func bindMount(root string, b Bind) error {
+	dst := filepath.Join(root, b.Dst)
+	fi, err := os.Stat(b.Src)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		err = os.MkdirAll(dst, 0755)
+	} else {
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(dst, []byte{}, 0644)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot create mount point for %s: %s", b.Src, err)
+	}
+	if err := syscall.Mount(b.Src, dst, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("cannot bind %s: %s", b.Src, err)
+	}
+	if !b.ReadOnly {
+		return nil
+	}
+	// A remount must keep the flags which the host locked on the mount.
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(dst, &st); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for stFlag, msFlag := range map[int64]uintptr{
+		0x2:    syscall.MS_NOSUID,
+		0x4:    syscall.MS_NODEV,
+		0x8:    syscall.MS_NOEXEC,
+		0x400:  syscall.MS_NOATIME,
+		0x800:  syscall.MS_NODIRATIME,
+		0x1000: syscall.MS_RELATIME,
+	} {
+		if int64(st.Flags)&stFlag != 0 {
+			flags = flags | msFlag
+		}
+	}
+	if err := syscall.Mount("", dst, "", flags, ""); err != nil {
+		return fmt.Errorf("cannot make %s read-only: %s", b.Src, err)
+	}
+	return nil
+}
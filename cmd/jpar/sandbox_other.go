@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func sandboxAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func checkSandbox() error {
+	return errors.New("sandboxes require linux namespaces")
+}
+
+func sandboxInit(arg string) {
+	fmt.Fprintln(os.Stderr, "jpar sandbox: sandboxes require linux namespaces")
+	os.Exit(127)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jmyounker/jtools/internal/mustache"
+)
+
+// Number of records read ahead when scheduling by priority.
+const DEFAULT_LOOKAHEAD = 100
+
+// scheduler decides which job runs next.  Up to lookahead jobs are held
+// back, and the held job with the highest priority is always sent first.
+// Jobs with equal priorities are sent in arrival order.
+//
+// When batching, the scheduler waits until it holds a full batch, or until
+// the input ends, and then sends the batch as a single job.
+//
+// With feedback enabled every dispatched job reports the new jobs it
+// produced, and the scheduler keeps running until all of them are done.
+type scheduler struct {
+	params    *Params
+	lookahead int
+	maxDepth  int             // deepest feedback job admitted, or 0 for no limit
+	results   chan Output     // receives jobs which cannot be scheduled
+	feedback  chan []Job      // nil unless feedback is enabled
+	seen      map[string]bool // keys of admitted jobs
+	seq       int             // sequence number of the next admitted job
+	running   int             // dispatched jobs which have not reported back
+	batch     int             // records per batch, or 0 for no limit
+	bytes     int             // argument bytes per batch, or 0 when not batching
+	queued    int             // argument bytes of the queued jobs
+	queue     jobHeap
+}
+
+func newScheduler(a *App, p *Params, results chan Output) *scheduler {
+	s := &scheduler{
+		params:    p,
+		lookahead: lookahead(a),
+		maxDepth:  a.MaxDepth,
+		results:   results,
+		seen:      map[string]bool{},
+		batch:     p.Batch,
+		bytes:     p.BatchBytes,
+	}
+	if a.Feedback {
+		s.feedback = make(chan []Job)
+	}
+	return s
+}
+
+// run moves jobs from in to out.  It returns once in is closed and every
+// job has been sent and, with feedback, has completed.
+func (s *scheduler) run(in <-chan Job, out chan<- Job) {
+	for in != nil || s.queue.Len() > 0 || s.running > 0 {
+		var send chan<- Job
+		var next Job
+		if s.ready(in == nil) {
+			send = out
+			next = s.take()
+		}
+		recv := in
+		if s.queue.Len() >= s.lookahead && (s.bytes == 0 || s.full()) {
+			recv = nil
+		}
+		sent := false
+		select {
+		case j, ok := <-recv:
+			if ok {
+				s.admit(j)
+			} else {
+				in = nil
+			}
+		case send <- next:
+			sent = true
+			if s.feedback != nil {
+				s.running = s.running + 1
+			}
+		case jobs := <-s.feedback:
+			s.running = s.running - 1
+			for _, j := range jobs {
+				s.admit(j)
+			}
+		}
+		if send != nil && !sent {
+			s.restore(next)
+		}
+	}
+}
+
+// ready reports whether a job can be sent.  Batches are only sent when
+// they are full or when no more input will arrive.
+func (s *scheduler) ready(closed bool) bool {
+	if s.queue.Len() == 0 {
+		return false
+	}
+	return s.bytes == 0 || closed || s.full()
+}
+
+// full reports whether the queue holds at least a full batch.
+func (s *scheduler) full() bool {
+	return (s.batch > 0 && s.queue.Len() >= s.batch) || s.queued >= s.bytes
+}
+
+// take removes the next job from the queue.  When batching, the job
+// carries as many of the queued records as fit into one batch.
+func (s *scheduler) take() Job {
+	j := heap.Pop(&s.queue).(Job)
+	s.queued = s.queued - j.Size
+	if s.bytes == 0 {
+		return j
+	}
+	batch := []Job{j}
+	size := j.Size
+	for s.queue.Len() > 0 && (s.batch == 0 || len(batch) < s.batch) {
+		if size+s.queue[0].Size > s.bytes {
+			break
+		}
+		x := heap.Pop(&s.queue).(Job)
+		s.queued = s.queued - x.Size
+		size = size + x.Size
+		batch = append(batch, x)
+	}
+	return Job{Value: j.Value, Seq: j.Seq, Priority: j.Priority, Depth: j.Depth, Batch: batch}
+}
+
+// restore returns a job which could not be sent to the queue.
+func (s *scheduler) restore(j Job) {
+	if j.Batch == nil {
+		s.queued = s.queued + j.Size
+		heap.Push(&s.queue, j)
+		return
+	}
+	for _, x := range j.Batch {
+		s.queued = s.queued + x.Size
+		heap.Push(&s.queue, x)
+	}
+}
+
+// admit numbers and queues a job, dropping it if it is too deep or has
+// been seen before.
+func (s *scheduler) admit(j Job) {
+	if s.maxDepth > 0 && j.Depth > s.maxDepth {
+		return
+	}
+	if s.params.Key != nil {
+		k := s.params.Key.Render(false, j.Value)
+		if s.seen[k] {
+			return
+		}
+		s.seen[k] = true
+	}
+	j.Seq = s.seq
+	s.seq = s.seq + 1
+	if s.params.Priority != nil {
+		p, err := renderPriority(s.params.Priority, j.Value)
+		if err != nil {
+			r := NewJobRun(&[]string{}, j.Value)
+			r.Errors = append(r.Errors, err.Error())
+			s.results <- Output{Value: r, Claim: j.Claim}
+			return
+		}
+		j.Priority = p
+	}
+	if s.bytes > 0 {
+		j.Size = batchSize(s.params, j)
+		s.queued = s.queued + j.Size
+	}
+	heap.Push(&s.queue, j)
+}
+
+// lookahead is the number of jobs held back for scheduling.  Without
+// priorities jobs are dispatched in arrival order.
+func lookahead(a *App) int {
+	if a.Priority == "" {
+		return 1
+	}
+	if a.Lookahead == 0 {
+		return DEFAULT_LOOKAHEAD
+	}
+	return a.Lookahead
+}
+
+func renderPriority(t *mustache.Template, data interface{}) (float64, error) {
+	s := strings.TrimSpace(t.Render(false, data))
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse priority %q: %s", s, err)
+	}
+	return p, nil
+}
+
+// jobHeap is a max-heap of jobs ordered by priority and then by sequence.
+type jobHeap []Job
+
+func (h jobHeap) Len() int { return len(h) }
+
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].Priority != h[j].Priority {
+		return h[i].Priority > h[j].Priority
+	}
+	return h[i].Seq < h[j].Seq
+}
+
+func (h jobHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *jobHeap) Push(x interface{}) { *h = append(*h, x.(Job)) }
+
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jmyounker/jtools/internal/mustache"
+)
+
+// Sinks routes job runs to their destinations.  Successful and failed
+// job runs go to stdout unless they have their own file.
+type Sinks struct {
+	Success io.Writer
+	Failure io.Writer
+	Tmpl    *mustache.Template // renders each job run instead of JSON
+	files   []*os.File
+}
+
+func sinksFromApp(a *App) (*Sinks, error) {
+	s := &Sinks{Success: os.Stdout, Failure: os.Stdout}
+	if a.OutputTemplate != "" {
+		t, err := mustache.ParseString(a.OutputTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse output template: %s", a.OutputTemplate)
+		}
+		s.Tmpl = t
+	}
+	if a.SuccessOut != "" {
+		f, err := s.create(a.SuccessOut)
+		if err != nil {
+			return nil, err
+		}
+		s.Success = f
+	}
+	if a.FailuresOut != "" {
+		if a.FailuresOut == a.SuccessOut {
+			s.Failure = s.Success
+			return s, nil
+		}
+		f, err := s.create(a.FailuresOut)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.Failure = f
+	}
+	return s, nil
+}
+
+func (s *Sinks) create(fn string) (*os.File, error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file %q for writing: %s", fn, err)
+	}
+	s.files = append(s.files, f)
+	return f, nil
+}
+
+// Write sends r to the sink matching its outcome.
+func (s *Sinks) Write(r *JobRun) error {
+	w := s.Success
+	if r.Failed() {
+		w = s.Failure
+	}
+	out, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if s.Tmpl != nil {
+		// Render from the JSON form so that templates use the same names
+		// as the output records.
+		var x interface{}
+		if err := json.Unmarshal(out, &x); err != nil {
+			return err
+		}
+		out = []byte(s.Tmpl.Render(false, x))
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+func (s *Sinks) Close() error {
+	var err error
+	for _, f := range s.files {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	s.files = nil
+	return err
+}
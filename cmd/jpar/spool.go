@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default time after which a claim that has not been renewed is considered
+// abandoned.
+const DEFAULT_LEASE = 30 * time.Second
+
+// Time between scans of a spool directory when every job is claimed.
+const SPOOL_POLL_INTERVAL = time.Second
+
+// A Spool is a directory of jobs shared by cooperating jpar processes.
+//
+// Each job is stored as ID.job.  A process claims a job by exclusively
+// creating ID.lock, and renews its claim by touching the lock file.  When
+// the job completes the job run is stored as ID.result, and the job and
+// lock files are removed.  A lock which has not been renewed within the
+// lease is abandoned, and the job is claimed again.
+type Spool struct {
+	Dir   string
+	Lease time.Duration
+	host  string
+	mu    sync.Mutex
+	held  map[string]bool
+	count int
+}
+
+func NewSpool(dir string, lease time.Duration) (*Spool, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot use queue dir: %s", err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("queue dir %s is not a directory", dir)
+	}
+	if lease < time.Second {
+		return nil, fmt.Errorf("lease must be at least one second")
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return &Spool{Dir: dir, Lease: lease, host: host, held: map[string]bool{}}, nil
+}
+
+func (s *Spool) path(id string, ext string) string {
+	return filepath.Join(s.Dir, id+ext)
+}
+
+// uniq returns a name which no other process will generate.
+func (s *Spool) uniq() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count = s.count + 1
+	return fmt.Sprintf("%020d-%s-%d-%d", time.Now().UnixNano(), s.host, os.Getpid(), s.count)
+}
+
+// writeFile atomically replaces path with data.
+func (s *Spool) writeFile(path string, data []byte) error {
+	tmp := fmt.Sprintf("%s.tmp-%s", path, s.uniq())
+	if err := ioutil.WriteFile(tmp, data, 0666); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Enqueue adds every record from the stream to the spool.  Unless the
+// policy is INPUT_ERROR_STOP, records which cannot be parsed are logged and
+// left out.
+func (s *Spool) Enqueue(stream *os.File, policy string) error {
+	for x := range ReadJsonStream(stream, policy != INPUT_ERROR_STOP) {
+		if x.Err != nil {
+			if policy == INPUT_ERROR_STOP {
+				return errors.New(inputError(x))
+			}
+			log.Printf("skipping %s", inputError(x))
+			continue
+		}
+		data, err := json.Marshal(x.Value)
+		if err != nil {
+			return err
+		}
+		if err := s.writeFile(s.path(s.uniq(), ".job"), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Claims reads jobs from the spool until no unclaimed jobs remain and
+// every job claimed by another process has either completed or has been
+// abandoned and reclaimed.
+func (s *Spool) Claims() chan JsonRead {
+	out := make(chan JsonRead)
+	stop := make(chan struct{})
+	go s.renew(stop)
+	go func() {
+		defer close(out)
+		for {
+			ids, err := s.pending()
+			if err != nil {
+				out <- JsonRead{Err: err}
+				return
+			}
+			claimed := 0
+			waiting := 0
+			for _, id := range ids {
+				if s.holds(id) {
+					continue
+				}
+				if !s.claim(id) {
+					waiting = waiting + 1
+					continue
+				}
+				claimed = claimed + 1
+				out <- s.read(id)
+			}
+			if claimed == 0 && waiting == 0 {
+				// Renewal continues until the final results are written.
+				go func() {
+					s.waitForRelease()
+					close(stop)
+				}()
+				return
+			}
+			if claimed == 0 {
+				time.Sleep(SPOOL_POLL_INTERVAL)
+			}
+		}
+	}()
+	return out
+}
+
+// pending lists the spooled jobs in the order they were enqueued.
+func (s *Spool) pending() ([]string, error) {
+	fns, err := filepath.Glob(filepath.Join(s.Dir, "*.job"))
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, fn := range fns {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(fn), ".job"))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *Spool) holds(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.held[id]
+}
+
+// claim attempts to take the lock for job id.
+func (s *Spool) claim(id string) bool {
+	lock := s.path(id, ".lock")
+	if s.tryLock(lock) {
+		return s.hold(id)
+	}
+	fi, err := os.Stat(lock)
+	if err != nil || time.Since(fi.ModTime()) < s.Lease {
+		return false
+	}
+	// The claimant has died.  Only one process can move the lock aside,
+	// and that process is allowed to try again.
+	stale := fmt.Sprintf("%s.stale-%s", lock, s.uniq())
+	if err := os.Rename(lock, stale); err != nil {
+		return false
+	}
+	fi, err = os.Stat(stale)
+	if err == nil && time.Since(fi.ModTime()) < s.Lease {
+		// Another process reclaimed the job after the lock was checked, so
+		// put its lock back.
+		os.Link(stale, lock)
+		os.Remove(stale)
+		return false
+	}
+	os.Remove(stale)
+	if s.tryLock(lock) {
+		return s.hold(id)
+	}
+	return false
+}
+
+func (s *Spool) tryLock(lock string) bool {
+	f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return false
+	}
+	fmt.Fprintf(f, "{\"host\":%q,\"pid\":%d}\n", s.host, os.Getpid())
+	f.Close()
+	return true
+}
+
+// hold records a claim.  If the job finished while it was being claimed
+// then the claim is dropped.
+func (s *Spool) hold(id string) bool {
+	if _, err := os.Stat(s.path(id, ".result")); err == nil {
+		os.Remove(s.path(id, ".job"))
+		os.Remove(s.path(id, ".lock"))
+		return false
+	}
+	if _, err := os.Stat(s.path(id, ".job")); err != nil {
+		os.Remove(s.path(id, ".lock"))
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held[id] = true
+	return true
+}
+
+func (s *Spool) read(id string) JsonRead {
+	data, err := ioutil.ReadFile(s.path(id, ".job"))
+	if err != nil {
+		return JsonRead{Err: err, Claim: id}
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return JsonRead{Err: err, Claim: id}
+	}
+	return JsonRead{Value: v, Claim: id}
+}
+
+// renew touches the locks of held jobs until stop is closed.
+func (s *Spool) renew(stop chan struct{}) {
+	t := time.NewTicker(s.Lease / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			now := time.Now()
+			s.mu.Lock()
+			for id := range s.held {
+				os.Chtimes(s.path(id, ".lock"), now, now)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Spool) waitForRelease() {
+	for {
+		s.mu.Lock()
+		n := len(s.held)
+		s.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(SPOOL_POLL_INTERVAL)
+	}
+}
+
+// Complete stores the job run for a claimed job and releases the claim.
+func (s *Spool) Complete(id string, r *JobRun) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	err = s.writeFile(s.path(id, ".result"), data)
+	if err == nil {
+		os.Remove(s.path(id, ".job"))
+	}
+	os.Remove(s.path(id, ".lock"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.held, id)
+	return err
+}
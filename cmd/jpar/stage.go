@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// StageRun records one command of a multi-stage pipeline.
+type StageRun struct {
+	Cmd        []string `json:"cmd"`
+	Prog       string   `json:"prog,omitempty"`
+	Returncode int      `json:"returncode"`
+	Stderr     string   `json:"stderr"`
+	StderrEnc  string   `json:"stderr_encoding,omitempty"`
+}
+
+// splitWords splits a stage into arguments at unquoted whitespace.  Single
+// quotes preserve everything up to the closing quote, and double quotes
+// preserve everything except backslash escapes.
+func splitWords(s string) ([]string, error) {
+	words := []string{}
+	word := strings.Builder{}
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in stage: %s", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// runPipeline runs the stages of r with each stage's stdout connected to
+// the next stage's stdin.  Like a shell with pipefail, the returncode is
+// that of the last stage which failed.
+func runPipeline(r *JobRun, launched func(pid int)) *JobRun {
+	cmds := []*exec.Cmd{}
+	stderrs := []*bytes.Buffer{}
+	for _, s := range r.Stages {
+		if len(s.Cmd) == 0 {
+			r.Outcome = OUTCOME_FAILURE
+			r.Errors = append(r.Errors, "empty stage")
+			return r
+		}
+		prog, err := exec.LookPath(s.Cmd[0])
+		if err != nil {
+			r.Outcome = OUTCOME_FAILURE
+			r.Errors = append(r.Errors, fmt.Sprintf("cannot locate command %s: %s", s.Cmd[0], err))
+			return r
+		}
+		s.Prog = prog
+		c := &exec.Cmd{Path: prog, Args: s.Cmd, Dir: r.Dir}
+		if r.Env != nil {
+			for k, v := range *r.Env {
+				c.Env = append(c.Env, fmt.Sprintf("%s=%s", k, v))
+			}
+		}
+		if r.sandbox != nil {
+			done, err := r.sandbox.wrap(c)
+			if err != nil {
+				r.Outcome = OUTCOME_FAILURE
+				r.Errors = append(r.Errors, err.Error())
+				return r
+			}
+			defer done()
+		}
+		serr := &bytes.Buffer{}
+		c.Stderr = serr
+		cmds = append(cmds, c)
+		stderrs = append(stderrs, serr)
+	}
+	last := r.Stages[len(r.Stages)-1]
+	r.Prog = &last.Prog
+
+	in, err := r.stdinBytes()
+	if err != nil {
+		r.Outcome = OUTCOME_FAILURE
+		r.Errors = append(r.Errors, fmt.Sprintf("cannot decode stdin: %s", err))
+		return r
+	}
+	cmds[0].Stdin = bytes.NewReader(in)
+	pipes := []*os.File{}
+	for i := 0; i < len(cmds)-1; i++ {
+		rd, wr, err := os.Pipe()
+		if err != nil {
+			closeAll(pipes)
+			r.Outcome = OUTCOME_FAILURE
+			r.Errors = append(r.Errors, fmt.Sprintf("cannot construct pipe: %s", err))
+			return r
+		}
+		cmds[i].Stdout = wr
+		cmds[i+1].Stdin = rd
+		pipes = append(pipes, rd, wr)
+	}
+	sout := &bytes.Buffer{}
+	cmds[len(cmds)-1].Stdout = sout
+
+	for i, c := range cmds {
+		if err := c.Start(); err != nil {
+			closeAll(pipes)
+			for _, started := range cmds[:i] {
+				started.Process.Kill()
+				started.Wait()
+			}
+			r.Outcome = OUTCOME_FAILURE
+			r.Errors = append(r.Errors, fmt.Sprintf("failed to launch cmd: %s", err))
+			return r
+		}
+		launched(c.Process.Pid)
+	}
+	// The children hold their own copies of the pipes.  Closing ours lets
+	// each stage see the end of its input.
+	closeAll(pipes)
+
+	r.Returncode = 0
+	for i, c := range cmds {
+		c.Wait()
+		stat := c.ProcessState.Sys().(syscall.WaitStatus)
+		rc := int(uint32(stat))
+		r.Stages[i].Returncode = rc
+		r.Stages[i].Stderr = stderrs[i].String()
+		if rc != 0 {
+			r.Returncode = rc
+		}
+	}
+	r.Stdout = sout.String()
+	r.Stderr = last.Stderr
+	r.Outcome = OUTCOME_SUCCESS
+	return r
+}
+
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
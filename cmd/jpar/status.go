@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of failed job runs retained for the status endpoint.
+const RECENT_FAILURES = 32
+
+// Status tracks what a jpar run is currently doing.  It is updated by the
+// feeder, the workers, and the output routine, and read by the status server.
+type Status struct {
+	mu           sync.Mutex
+	started      time.Time
+	read         int
+	completed    int
+	succeeded    int
+	failed       int
+	hookFailures int
+	running      map[int]*runningJob
+	failures     []*JobRun
+}
+
+type runningJob struct {
+	Worker  int       `json:"worker"`
+	Cmd     []string  `json:"cmd"`
+	Pid     int       `json:"pid,omitempty"`
+	Started time.Time `json:"started"`
+	Elapsed float64   `json:"elapsed"`
+}
+
+type counters struct {
+	Read         int     `json:"read"`
+	Running      int     `json:"running"`
+	Completed    int     `json:"completed"`
+	Succeeded    int     `json:"succeeded"`
+	Failed       int     `json:"failed"`
+	HookFailures int     `json:"hook-failures"`
+	Parallelism  int     `json:"parallelism"`
+	Elapsed      float64 `json:"elapsed"`
+}
+
+type parallelism struct {
+	Parallelism int `json:"parallelism"`
+}
+
+func NewStatus() *Status {
+	return &Status{
+		started:  time.Now(),
+		running:  map[int]*runningJob{},
+		failures: []*JobRun{},
+	}
+}
+
+// Read records that an input record has been read.
+func (s *Status) Read() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.read = s.read + 1
+}
+
+// Begin records that worker id is about to run r.
+func (s *Status) Begin(id int, r *JobRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd := []string{}
+	if r.Cmd != nil {
+		cmd = append(cmd, *r.Cmd...)
+	}
+	s.running[id] = &runningJob{Worker: id, Cmd: cmd, Started: time.Now()}
+}
+
+// Launched records the pid of the process running on worker id.
+func (s *Status) Launched(id int, pid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.running[id]; ok {
+		j.Pid = pid
+	}
+}
+
+// End records that worker id is no longer running a job.
+func (s *Status) End(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, id)
+}
+
+// Record counts a job run as it is written to the output.
+func (s *Status) Record(r *JobRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Hook == "" {
+		s.completed = s.completed + 1
+		if !r.Failed() {
+			s.succeeded = s.succeeded + 1
+			return
+		}
+		s.failed = s.failed + 1
+	} else {
+		// Worker hooks are not jobs, so they are counted apart from the
+		// records which were read.  Only failed hooks are recorded.
+		s.hookFailures = s.hookFailures + 1
+	}
+	s.failures = append(s.failures, r)
+	if len(s.failures) > RECENT_FAILURES {
+		s.failures = s.failures[len(s.failures)-RECENT_FAILURES:]
+	}
+}
+
+func (s *Status) runningJobs() []*runningJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	jobs := []*runningJob{}
+	for _, j := range s.running {
+		x := *j
+		x.Elapsed = now.Sub(j.Started).Seconds()
+		jobs = append(jobs, &x)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Worker < jobs[j].Worker })
+	return jobs
+}
+
+func (s *Status) counters(parallelism int) counters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return counters{
+		Read:         s.read,
+		Running:      len(s.running),
+		Completed:    s.completed,
+		Succeeded:    s.succeeded,
+		Failed:       s.failed,
+		HookFailures: s.hookFailures,
+		Parallelism:  parallelism,
+		Elapsed:      time.Since(s.started).Seconds(),
+	}
+}
+
+func (s *Status) recentFailures() []*JobRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*JobRun{}, s.failures...)
+}
+
+// ServeStatus serves the status API on a unix domain socket at path.  The
+// returned function shuts the server down and removes the socket.
+func ServeStatus(path string, s *Status, p *pool) (func(), error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on status socket %s: %s", path, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, req *http.Request) {
+		writeJson(w, http.StatusOK, s.runningJobs())
+	})
+	mux.HandleFunc("/counters", func(w http.ResponseWriter, req *http.Request) {
+		writeJson(w, http.StatusOK, s.counters(p.Size()))
+	})
+	mux.HandleFunc("/failures", func(w http.ResponseWriter, req *http.Request) {
+		writeJson(w, http.StatusOK, s.recentFailures())
+	})
+	mux.HandleFunc("/parallelism", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			writeJson(w, http.StatusOK, parallelism{p.Size()})
+		case http.MethodPut, http.MethodPost:
+			x := parallelism{}
+			if err := json.NewDecoder(req.Body).Decode(&x); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("cannot parse request: %s", err))
+				return
+			}
+			if err := p.Resize(x.Parallelism); err != nil {
+				writeError(w, http.StatusConflict, err.Error())
+				return
+			}
+			writeJson(w, http.StatusOK, parallelism{p.Size()})
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "use GET or PUT")
+		}
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	return func() {
+		srv.Close()
+		os.Remove(path)
+	}, nil
+}
+
+func writeJson(w http.ResponseWriter, code int, x interface{}) {
+	out, err := json.Marshal(x)
+	if err != nil {
+		code = http.StatusInternalServerError
+		out = []byte(fmt.Sprintf(`{"error":%q}`, err.Error()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(out)
+	w.Write([]byte("\n"))
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJson(w, code, map[string]string{"error": msg})
+}